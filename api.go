@@ -25,6 +25,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // Mode is used as a constant
@@ -50,27 +51,78 @@ const (
 	// IndMode implements this.
 	IndMode = Mode(0)
 
+	// ExtendedActiveMode is the active mode using EPRT
+	// instead of PORT, see https://tools.ietf.org/html/rfc2428.
+	// If the server doesn't implement EPRT, PORT is used.
+	ExtendedActiveMode = Mode(3)
+
+	// ExtendedPassiveMode is the passive mode using EPSV
+	// instead of PASV, see https://tools.ietf.org/html/rfc2428.
+	// If the server doesn't implement EPSV, PASV is used.
+	ExtendedPassiveMode = Mode(4)
+
 	// AlreadyTLS is the error (error with this content)
 	// that is reported everytime an auth tls/ssl is issued
-	// on an already tls-ed-connection.
+	// on an already tls-ed-connection, see ErrAlreadyTLS.
 	AlreadyTLS = "The control connection is already SSL or TLS"
 
 	// FailToTLS is the error msg returned in case no support for
-	// SSL and TLS has been found.
+	// SSL and TLS has been found, see ErrNoTLS.
 	FailToTLS = "The server doesn't support neither SSL or TLS"
 
 	// AbortOk is the expected return code for an ABORT code.
 	AbortOk = 426
 
+	// AccountNeeded is the return code for a PASS command
+	// when an account is needed to log in, see Account.
+	AccountNeeded = 332
+
+	// AlloOk is the expected return code for an ALLO command.
+	AlloOk = 200
+
+	// AuthOk is the expected return code for an AUTH command.
+	// see https://tools.ietf.org/html/rfc2228#page-27
+	AuthOk = 234
+
+	// CantOpenDataConn is the return code when the
+	// server can't open the data connection.
+	CantOpenDataConn = 425
+
 	// CdOk is the expected return code for a CWD.
 	CdOk = 250
 
+	// CdUpOk is the expected return code for a CDUP command,
+	// some servers reply with CdOk.
+	CdUpOk = 200
+
 	// DeleteFileOk is the expected return code when a file has been removed.
 	DeleteFileOk = 250
 
 	// DeleteDirOk is the expected return code when a file has been removed.
 	DeleteDirOk = 250
 
+	// EprtOk is the expected return code for an EPRT command.
+	EprtOk = 200
+
+	// EpsvOk is the expected return code for an EPSV command.
+	EpsvOk = 229
+
+	// ExceededStorage is the return code when the storage
+	// allocation of the user, or the space, has been exceeded.
+	ExceededStorage = 552
+
+	// FeatOk is the expected return code for a FEAT command.
+	// see https://tools.ietf.org/html/rfc2389#section-3.2
+	FeatOk = 211
+
+	// FileActionNotTaken is the return code when the file doesn't
+	// exist or can't be accessed.
+	FileActionNotTaken = 550
+
+	// FileStatusOk is the expected return code for a command
+	// that opens a data connection, e.g. RETR, STOR, LIST.
+	FileStatusOk = 150
+
 	// FileUnavailable is the return code when a file doesn't exists/is busy
 	// or something similar.
 	FileUnavailable = 450
@@ -78,50 +130,167 @@ const (
 	// FirstConnOk is what server writes when a connection occured.
 	FirstConnOk = 220
 
+	// HashOk is the expected return code for a HASH command.
+	// see https://tools.ietf.org/html/draft-bryan-ftpext-hash-02#section-3
+	HashOk = 213
+
+	// HelpOk is the expected return code for a HELP command.
+	HelpOk = 214
+
+	// InsufficientStorage is the return code when the server
+	// has not enough storage space at the moment.
+	InsufficientStorage = 452
+
 	// LastModificationTimeOk is the expected returned code for
 	// MDTM command.
 	// see https://tools.ietf.org/html/rfc3659#page-8
 	LastModificationTimeOk = 213
 
+	// LegacyHashOk is the expected return code for the XCRC, XMD5,
+	// XSHA1, XSHA256 and XSHA512 commands.
+	LegacyHashOk = 250
+
 	// LoginOk is the expected return code for a PASS command.
 	LoginOk = 230
 
+	// MfmtOk is the expected return code for a MFMT command.
+	// see https://tools.ietf.org/html/draft-somers-ftp-mfxx-04#section-3
+	MfmtOk = 213
+
 	// MkDirOk is the expected return code for a MKD command.
 	MkDirOk = 257
 
+	// MlstOk is the expected return code for a MLST command.
+	// see https://tools.ietf.org/html/rfc3659#section-7.2
+	MlstOk = 250
+
+	// NeedAccount is the return code when an account
+	// is needed to store files.
+	NeedAccount = 532
+
+	// NetworkProtocolNotSupported is the return code of EPRT and EPSV
+	// when the server doesn't support the requested network protocol.
+	// see https://tools.ietf.org/html/rfc2428#section-2
+	NetworkProtocolNotSupported = 522
+
 	// NoopOk is the expected return code for a NOOP command.
 	NoopOk = 200
 
+	// NotImplemented is the return code when the server doesn't
+	// implement the command.
+	NotImplemented = 502
+
+	// NotImplementedParam is the return code when the server doesn't
+	// implement the parameter of the command.
+	NotImplementedParam = 504
+
+	// NotLoggedIn is the return code when the user is not logged in,
+	// or the credentials are wrong.
+	NotLoggedIn = 530
+
 	// NotSupported is the return code when the server doesn't support
 	// the feature/command/requested.
 	NotSupported = 431
 
+	// OptsOk is the expected return code for an OPTS command.
+	OptsOk = 200
+
 	// PasvOk is the expected return code for a PASV command.
 	PasvOk = 227
 
+	// PbszOk is the expected return code for a PBSZ command.
+	PbszOk = 200
+
+	// PolicyDenied is the return code when the request
+	// is denied for policy reasons.
+	// see https://tools.ietf.org/html/rfc2228#page-27
+	PolicyDenied = 534
+
 	// PortOk is the expected return code for a PORT command.
 	PortOk = 200
 
+	// ProtOk is the expected return code for a PROT command.
+	ProtOk = 200
+
+	// ProtectionDenied is the return code when the protection
+	// level of the command is denied for policy reasons.
+	ProtectionDenied = 533
+
 	// PwdOk is the expected return code for a PWD command.
 	PwdOk = 257
 
 	// QuitOk is the expected return code for a QUIT command.
 	QuitOk = 221
 
+	// RangOk is the expected return code for a RANG command.
+	// see https://tools.ietf.org/html/draft-bryan-ftp-range-08#section-3
+	RangOk = 350
+
+	// ReinOk is the expected return code for a REIN command.
+	ReinOk = 220
+
+	// RestOk is the expected return code for a REST command.
+	// see https://tools.ietf.org/html/rfc3659#section-5.5
+	RestOk = 350
+
+	// ServiceNotAvailable is the return code when the server
+	// is closing the control connection.
+	ServiceNotAvailable = 421
+
+	// ServiceNotReady is the return code when the server will
+	// be ready in some minutes, another reply follows.
+	ServiceNotReady = 120
+
+	// SiteOk is the expected return code for a SITE command.
+	SiteOk = 200
+
 	// SizeOk is the expected returned code for a SIZE command.
 	// see https://tools.ietf.org/html/rfc3659#page-11
 	SizeOk = 213
 
+	// SmntOk is the expected return code for a SMNT command.
+	SmntOk = 250
+
+	// StatDirOk is the expected return code for a STAT
+	// command on a directory.
+	StatDirOk = 212
+
+	// StatFileOk is the expected return code for a STAT
+	// command on a file, some servers use it for directories too.
+	StatFileOk = 213
+
+	// StatOk is the expected return code for a STAT
+	// command without arguments.
+	StatOk = 211
+
+	// Superfluous is the return code when the command
+	// is not needed by the server, e.g. ALLO or ACCT.
+	Superfluous = 202
+
+	// SyntaxError is the return code when the server doesn't
+	// recognize the command.
+	SyntaxError = 500
+
+	// SyntaxErrorParams is the return code when the server doesn't
+	// recognize the parameters of the command.
+	SyntaxErrorParams = 501
+
+	// SystOk is the expected return code for a SYST command.
+	SystOk = 215
+
 	// TransferOk is the expected returned code received upon
 	// a transfer completion.
 	TransferOk = 226
 
+	// TypeOk is the expected return code for a TYPE command.
+	TypeOk = 200
+
 	// UsernameOk is the expected return code for a USER command.
 	UsernameOk = 331
 
 	// InvalidMode is the error msg returned when default Mode is passed
 	// and it is not allowed.
-	InvalidMode = "invalid Mode, only ActiveMode and ModePassive are allowed"
+	InvalidMode = "invalid Mode, only ActiveMode, PassiveMode, ExtendedActiveMode and ExtendedPassiveMode are allowed"
 
 	// ActiveModeStr is the FTP mode active.
 	ActiveModeStr = "active"
@@ -129,6 +298,12 @@ const (
 	// PassiveModeStr is the FTP mode passive.
 	PassiveModeStr = "passive"
 
+	// ExtendedActiveModeStr is the FTP mode extended active.
+	ExtendedActiveModeStr = "extended-active"
+
+	// ExtendedPassiveModeStr is the FTP mode extended passive.
+	ExtendedPassiveModeStr = "extended-passive"
+
 	// DefaultModeStr is a 'no-matters' FTP mode.
 	DefaultModeStr = "default"
 
@@ -155,9 +330,24 @@ func (e *UnexpectedCodeError) Error() string {
 		e.Got)
 }
 
+// FeatureNotSupportedError is the error returned when the server
+// has not advertised, in its FEAT reply, the feature required to
+// accomplish the operation.
+type FeatureNotSupportedError struct {
+	Feature string
+}
+
+func newFeatureNotSupportedError(feature string) error {
+	return &FeatureNotSupportedError{Feature: feature}
+}
+
+func (e *FeatureNotSupportedError) Error() string {
+	return fmt.Sprintf("feature not supported by the server: %s", e.Feature)
+}
+
 func unexpectedErrorOrResponse(expected int, response *Response) (*Response, error) {
 	if response.Code != expected {
-		return nil, newUnexpectedCodeError(expected, response.Code)
+		return nil, newProtocolError(expected, response)
 	}
 	return response, nil
 }
@@ -170,21 +360,43 @@ type Config struct {
 	//Where to put response from the server.
 	//Usually it is set to /dev/null or os.Stdin.
 	// ResponseFile *os.File
-	//Optionally, the tls configuration to use for
-	//the connection. This is required only if
-	// you think TLS will be used. Note that the library
-	// will overwrite some parameters, including MinVersion,
-	// according to AllowSSL. Only version 3.0  is allowed. If SSL
-	// is not allowed, the MinVersion will be set to TLS 1.2,
-	// except if you set another version gt SSL3 lte TLS 1.2.
-	// This is done in the Dial function.
-	tlsConfig *tls.Config
 	TLSOption *TLSOption
 	LocalIP   net.IP
 	LocalPort int
 	Username  string
 	Password  string
 	FirstPort int
+	// Account is sent with ACCT if the server
+	// asks for it after the password.
+	Account string
+	// Retry, if not nil, is the policy used to retry the commands
+	// and the transfers that fail for a transient reason.
+	Retry *RetryPolicy
+	// KeepAlive, if not 0, is the interval of the NOOPs sent over the
+	// control connection when it's not used, both while the connection
+	// is idle and during the transfers, so that the firewalls don't drop
+	// it. It's the keep-alive period of the TCP connection as well.
+	KeepAlive time.Duration
+	// IdleTimeout, if not 0, closes the connection, as Quit does,
+	// once it has not been used for that long. The NOOPs sent
+	// because of KeepAlive don't count as a use.
+	IdleTimeout time.Duration
+	// DialTimeout, if not 0, bounds the connection to the server,
+	// including the greeting and the TLS negotiation.
+	DialTimeout time.Duration
+	// CommandTimeout, if not 0, bounds the wait for each reply
+	// of the server.
+	CommandTimeout time.Duration
+	// DataConnTimeout, if not 0, bounds the establishment of
+	// each data connection.
+	DataConnTimeout time.Duration
+	// StallTimeout, if not 0, fails a transfer when no bytes
+	// are sent or received for that long.
+	StallTimeout time.Duration
+	// The expiration of each of them is reported as a *TimeoutError.
+
+	// RateLimit, if not nil, limits the bandwidth of all the transfers.
+	RateLimit *RateLimiter
 }
 
 // TLSOption is the struct passed to configure TLS params.
@@ -211,9 +423,76 @@ type TLSOption struct {
 	SkipVerify bool
 	// same value for tls.Conf.ServerName
 	ServerName string
+	// If set to true, as soon as the control connection
+	// is TLS-ed, PBSZ 0 and PROT P are sent, so that data
+	// connections are protected as well.
+	ProtectData bool
+}
+
+// ProtectionLevel is the data channel protection level,
+// as set by the PROT command.
+// See https://tools.ietf.org/html/rfc4217#section-9
+type ProtectionLevel string
+
+const (
+	// ProtectionClear means that data connections are
+	// not protected. This is the default.
+	ProtectionClear = ProtectionLevel("C")
+
+	// ProtectionPrivate means that data connections
+	// are TLS-ed.
+	ProtectionPrivate = ProtectionLevel("P")
+)
+
+// Progress receives the progress of a transfer,
+// it replaces the `startingChan` and `onEachChan` channels
+// of the channel-based functions.
+type Progress interface {
+	// Started is called once the data connection is open.
+	Started()
+	// Transferred is called after each chunk with its size in bytes.
+	Transferred(n int)
+}
+
+// TransferOptions are the optional params of the context-based transfers.
+// A nil *TransferOptions means the defaults.
+type TransferOptions struct {
+	// Progress, if not nil, is notified about the transfer.
+	Progress Progress
+	// BufferSize is the custom buffer size to use for the transfer,
+	// 0 means the default one.
+	BufferSize int
+	// DeleteIfAbort deletes the remote file if an upload is aborted.
+	DeleteIfAbort bool
+	// RateLimit, if not nil, limits the bandwidth of the transfer,
+	// along with the RateLimit of the Config.
+	RateLimit *RateLimiter
+	// Type, if not empty, is used instead of the one set with SetType.
+	Type TransferType
+	// PreserveTimes sets the modification time of the copy equal to
+	// the one of the original, see Conn.SetModificationTime.
+	PreserveTimes bool
+	// VerifyChecksum, if not empty, hashes the bytes transferred
+	// and compares them with the hash computed by the server, see
+	// Conn.Hash; a *ChecksumMismatchError is returned if they differ.
+	// When a resumed transfer can't be hashed with HashRange, the
+	// whole local and remote files are compared.
+	// With TypeASCII the server may store different line endings,
+	// so it's meant for TypeBinary.
+	VerifyChecksum HashAlgorithm
+	// Resume continues a partial transfer instead of restarting it.
+	// A download restarts (REST STREAM) from the size of the local file,
+	// that is kept if the transfer is aborted. An upload appends (APPE)
+	// the local file starting from the size of the remote one.
+	// If the destination is already complete nothing is transferred.
+	Resume bool
 }
 
 // Conn represents the top level object.
+// It can be used by multiple goroutines: commands and transfers are
+// serialized, so a command waits for the one in progress to finish,
+// and for the whole transfer if one is running. Operations made of
+// many commands, such as Walk or UploadDir, are not atomic.
 type Conn struct {
 	control      net.Conn
 	controlRw    *bufio.ReadWriter
@@ -222,6 +501,55 @@ type Conn struct {
 	portLock     sync.Mutex
 	bufferSize   int
 
+	// features is the cached reply to FEAT, nil
+	// until the first call to Features.
+	features *Features
+	// utf8 is true once OPTS UTF8 ON has been accepted.
+	utf8 bool
+	// protection is the level set by PROT.
+	protection ProtectionLevel
+	// noExtendedModes is true once the server has
+	// refused EPSV or EPRT, so that they are not tried anymore.
+	noExtendedModes bool
+	// tlsConfig is the TLS configuration of the control connection,
+	// built from the TLSOption of the config when dialing: the MinVersion
+	// is SSL 3.0 only if AllowSSL, TLS 1.2 otherwise. dataTLSConfig is
+	// the same, but it is used for the data connections, resuming
+	// the session of the control connection.
+	tlsConfig     *tls.Config
+	dataTLSConfig *tls.Config
+	// lastDataTLSState is the TLS state of the last
+	// data connection, nil if it wasn't protected.
+	lastDataTLSState *tls.ConnectionState
+	// remote is the address the control connection is dialed to.
+	remote string
+	// loggedIn is true once the credentials have been accepted, and
+	// cwd is the working directory set with Cd, known only if a
+	// RetryPolicy is used. They're used to restore the session
+	// when reconnecting.
+	loggedIn bool
+	cwd      string
+	// dataType is the type set with SetType, and serverType
+	// is the one in use by the server, "" if unknown.
+	dataType   TransferType
+	serverType TransferType
+	// lastCommand is the name of the last command
+	// sent, used in the ProtocolErrors.
+	lastCommand string
+	// system is the system type told by SYST, and
+	// systAsked is true once SYST has been sent.
+	system    string
+	systAsked bool
+
+	// lock is held during every exchange over the control
+	// connection, and for the whole length of a transfer.
+	lock controlLock
+	// lastUsed is when the lock has been released the last time.
+	lastUsed time.Time
+	// pendingNoops are the NOOPs sent during a transfer
+	// whose reply has not been read yet.
+	pendingNoops int
+
 	// These two are used to implement graceful shutdown.
 	// When we a used calls quit, the cancel function is called,
 	// causing the internal context's channel to send a value,
@@ -250,6 +578,10 @@ func GetMode(mode string) (Mode, error) {
 		ftpMode = ActiveMode
 	} else if mode == PassiveModeStr {
 		ftpMode = PassiveMode
+	} else if mode == ExtendedActiveModeStr {
+		ftpMode = ExtendedActiveMode
+	} else if mode == ExtendedPassiveModeStr {
+		ftpMode = ExtendedPassiveMode
 	} else if mode == DefaultModeStr {
 		ftpMode = IndMode
 	} else {
@@ -269,6 +601,10 @@ func modeStr(mode Mode) string {
 		modeStr = "active"
 	} else if mode == PassiveMode {
 		modeStr = "passive"
+	} else if mode == ExtendedActiveMode {
+		modeStr = "extended-active"
+	} else if mode == ExtendedPassiveMode {
+		modeStr = "extended-passive"
 	} else {
 		modeStr = "default"
 	}
@@ -279,8 +615,16 @@ func modeStr(mode Mode) string {
 type Response struct {
 	// Response code received from the server.
 	Code int
-	// Msg sent from the server.
+	// Msg sent from the server. For multi-line replies
+	// this is the text of the first line.
 	Msg string
+	// Lines contains every line of the reply, with the
+	// leading code stripped where present. Single-line replies
+	// have exactly one element, equal to Msg.
+	Lines []string
+	// command is the name of the command
+	// the response is about.
+	command string
 }
 
 // Response implements error.
@@ -18,30 +18,48 @@ package ftp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/nbena/ftp/listing"
 )
 
 // Dial connects to the ftp server using the given configuration,
 // it returns a `Conn`, the server response, or an error.
 // It only setups the TCP connection for the control channel, no credentials are sent.
 func Dial(remote string, config *Config) (*Conn, *Response, error) {
-	return internalDial(remote, config)
+	return internalDial(context.Background(), remote, config)
+}
+
+// DialContext is like Dial, but the connection, the greeting and the
+// eventual TLS negotiation are aborted when `ctx` is done.
+// Once returned, `ctx` has no effect on the connection.
+func DialContext(ctx context.Context, remote string, config *Config) (*Conn, *Response, error) {
+	conn, response, err := internalDial(ctx, remote, config)
+	if err != nil && ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	return conn, response, err
 }
 
 // DialAndAuthenticate connects to the server and
 // authenticates with it.
 func DialAndAuthenticate(remote string, config *Config) (*Conn, *Response, error) {
-	conn, _, err := internalDial(remote, config)
+	conn, _, err := internalDial(context.Background(), remote, config)
 	if err != nil {
 		return nil, nil, err
 	}
 	resp, err := conn.Authenticate()
 	if err != nil {
+		conn.close()
 		return nil, nil, err
 	}
 	return conn, resp, nil
@@ -51,6 +69,15 @@ func DialAndAuthenticate(remote string, config *Config) (*Conn, *Response, error
 // an error if an error occurs in sending/receiving or
 // if the credential are wrong.
 func (f *Conn) Authenticate() (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.authenticate()
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) authenticate() (*Response, error) {
 
 	// Sending the username.
 	response, err := f.writeCommandAndGetResponse("USER " + f.config.Username + "\r\n")
@@ -59,7 +86,7 @@ func (f *Conn) Authenticate() (*Response, error) {
 	}
 	// if it's not the response code we expect...
 	if response.Code != UsernameOk {
-		return nil, newUnexpectedCodeError(UsernameOk, response.Code)
+		return nil, newProtocolError(UsernameOk, response)
 	}
 
 	// now sending the password.
@@ -67,6 +94,21 @@ func (f *Conn) Authenticate() (*Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	if response.Code == AccountNeeded && f.config.Account != "" {
+		response, err = f.writeCommandAndGetResponse("ACCT " + f.config.Account + "\r\n")
+		if err != nil {
+			return nil, err
+		}
+	}
+	// features may change after the login.
+	f.features = nil
+	f.loggedIn = response.Code == LoginOk
+	if f.loggedIn {
+		// never relying on the default of the server,
+		// if it fails the transfers send it again.
+		f.serverType = ""
+		f.setType(TypeBinary)
+	}
 	return unexpectedErrorOrResponse(LoginOk, response)
 }
 
@@ -77,13 +119,23 @@ func (f *Conn) Quit() (*Response, error) {
 	// listen on the internal context to see whether it's being cancelled.
 	// So we send the cancel signal.
 	f.cancel()
-	// Now sending `QUIT`.
+	var response *Response
+	// waiting for the transfer in progress to be aborted.
+	err := f.locked(func() (err error) {
+		response, err = f.quit()
+		return
+	})
+	return response, err
+}
+
+// quit sends `QUIT` and closes the control channel.
+func (f *Conn) quit() (*Response, error) {
 	response, err := f.writeCommandAndGetResponse("QUIT\r\n")
 	if err != nil {
 		return nil, err
 	}
 	if response.Code != QuitOk {
-		return nil, newUnexpectedCodeError(QuitOk, response.Code)
+		return nil, newProtocolError(QuitOk, response)
 	}
 	// Closing the control channel.
 	err = f.control.Close()
@@ -92,6 +144,10 @@ func (f *Conn) Quit() (*Response, error) {
 
 // DeleteFile deletes the file at the given path.
 func (f *Conn) DeleteFile(filepath string) (*Response, error) {
+	return f.DeleteFileContext(context.Background(), filepath)
+}
+
+func (f *Conn) deleteFile(filepath string) (*Response, error) {
 	resp, err := f.writeCommandAndGetResponse("DELE " + filepath + "\r\n")
 	if err != nil {
 		return nil, err
@@ -101,6 +157,10 @@ func (f *Conn) DeleteFile(filepath string) (*Response, error) {
 
 // MkDir creates a directory named `name` ai the current path.
 func (f *Conn) MkDir(name string) (*Response, error) {
+	return f.MkDirContext(context.Background(), name)
+}
+
+func (f *Conn) mkDir(name string) (*Response, error) {
 	resp, err := f.writeCommandAndGetResponse("MKD " + name + "\r\n")
 	if err != nil {
 		return nil, err
@@ -110,6 +170,10 @@ func (f *Conn) MkDir(name string) (*Response, error) {
 
 // DeleteDir deletes the directory `name`.
 func (f *Conn) DeleteDir(name string) (*Response, error) {
+	return f.DeleteDirContext(context.Background(), name)
+}
+
+func (f *Conn) deleteDir(name string) (*Response, error) {
 	resp, err := f.writeCommandAndGetResponse("RMD " + name + "\r\n")
 	if err != nil {
 		return nil, err
@@ -119,13 +183,53 @@ func (f *Conn) DeleteDir(name string) (*Response, error) {
 
 // Cd change the working directory to `path`.
 func (f *Conn) Cd(path string) (*Response, error) {
+	return f.CdContext(context.Background(), path)
+}
+
+func (f *Conn) cd(path string) (*Response, error) {
 	resp, err := f.writeCommandAndGetResponse("CWD " + path + "\r\n")
 	if err != nil {
 		return nil, err
 	}
+	if resp.Code == CdOk {
+		f.rememberCwd()
+	}
 	return unexpectedErrorOrResponse(CdOk, resp)
 }
 
+// rememberCwd saves the working directory, if a RetryPolicy
+// is used, to get back there when reconnecting.
+func (f *Conn) rememberCwd() {
+	if f.config.Retry == nil {
+		return
+	}
+	if _, directory, err := f.pwd(); err == nil {
+		f.cwd = directory
+	}
+}
+
+// CdUp changes the working directory to the parent one.
+func (f *Conn) CdUp() (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.cdUp()
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) cdUp() (*Response, error) {
+	resp, err := f.writeCommandAndGetResponse("CDUP\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != CdUpOk && resp.Code != CdOk {
+		return nil, newProtocolError(CdUpOk, resp)
+	}
+	f.rememberCwd()
+	return resp, nil
+}
+
 // LsSimple performs a LIST on the current directory blocking the main goroutine.
 func (f *Conn) LsSimple(mode Mode) ([]string, error) {
 	// Here we'll get the result.
@@ -176,19 +280,63 @@ func (f *Conn) LsDir(mode Mode, path string, doneChan chan<- []string, errChan c
 	f.internalLs(mode, path, doneChan, errChan)
 }
 
+// NameList performs a NLST on `path`, or on the current directory if
+// `path` is empty, using the default mode. It returns only the names,
+// one per item, see NameListContext.
+func (f *Conn) NameList(path string) ([]string, error) {
+	return f.NameListContext(context.Background(), IndMode, path)
+}
+
+// NameListContext performs a NLST on `path`, or on the current directory
+// if `path` is empty. Depending on the server, the names can be
+// prefixed by `path`.
+func (f *Conn) NameListContext(ctx context.Context, mode Mode, path string) ([]string, error) {
+	if err := f.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.release()
+	cmd := "NLST\r\n"
+	if path != "" {
+		cmd = "NLST " + path + "\r\n"
+	}
+	var lines []string
+	err := f.retry(ctx, func() (err error) {
+		lines, err = f.dataLines(ctx, mode, cmd)
+		return
+	}, nil)
+	return lines, err
+}
+
 // Size returns the size of the specified file. The size
-// is not the size of the file but the number of bytes that
-// will be transmitted if the file would have been downloaded.
+// is the number of bytes that will be transmitted if the file would
+// have been downloaded using TypeBinary, that is sent before SIZE if
+// needed, since in TypeASCII it depends on the line endings.
 // According to RFC 3659, a 213 code must be returned if the
 // request is ok. If another code is returned, an error will be thrown.
 // Returns the server response, the size, or an error.
 func (f *Conn) Size(file string) (*Response, int, error) {
+	var response *Response
+	var size int
+	err := f.withContext(context.Background(), func() (err error) {
+		response, size, err = f.size(file)
+		return
+	})
+	return response, size, err
+}
+
+func (f *Conn) size(file string) (*Response, int, error) {
+	if !f.supports("SIZE") {
+		return nil, 0, newFeatureNotSupportedError("SIZE")
+	}
+	if err := f.ensureType(TypeBinary); err != nil {
+		return nil, 0, err
+	}
 	response, err := f.writeCommandAndGetResponse("SIZE " + file + "\r\n")
 	if err != nil {
 		return nil, 0, err
 	}
 	if response.Code != SizeOk {
-		return nil, 0, newUnexpectedCodeError(SizeOk, response.Code)
+		return nil, 0, newProtocolError(SizeOk, response)
 	}
 	// Now parsing the response.
 	size, err := strconv.Atoi(response.Msg)
@@ -201,26 +349,105 @@ func (f *Conn) Size(file string) (*Response, int, error) {
 // LastModificationTime returns the last modification time of the given file in
 // UTC format. The raw response is accessible, as well as the parsed date.
 func (f *Conn) LastModificationTime(file string) (*Response, *time.Time, error) {
+	var response *Response
+	var date *time.Time
+	err := f.withContext(context.Background(), func() (err error) {
+		response, date, err = f.lastModificationTime(file)
+		return
+	})
+	return response, date, err
+}
+
+func (f *Conn) lastModificationTime(file string) (*Response, *time.Time, error) {
+	if !f.supports("MDTM") {
+		return nil, nil, newFeatureNotSupportedError("MDTM")
+	}
 	response, err := f.writeCommandAndGetResponse("MDTM " + file + "\r\n")
 	if err != nil {
 		return nil, nil, err
 	}
 	if response.Code != LastModificationTimeOk {
-		return nil, nil, newUnexpectedCodeError(LastModificationTimeOk, response.Code)
+		return nil, nil, newProtocolError(LastModificationTimeOk, response)
 	}
 	date, err := response.getTime()
 	return response, date, err
 }
 
+// SetModificationTime sets the modification time of the given file.
+// Servers differ, so the commands are tried in order until one of them
+// is implemented: MFMT (https://tools.ietf.org/html/draft-somers-ftp-mfxx-04),
+// MDTM with the time before the file, SITE UTIME with the time before
+// the file and SITE UTIME with the file followed by the times.
+// MFMT and MDTM are skipped if the server doesn't advertise them.
+// A command is considered not implemented if it's rejected as a syntax
+// error (500, 501, 502 or 504), or, for MDTM, with a 550 reply while the
+// file exists, since most servers take the time as part of the file name.
+// If none of them is implemented a *FeatureNotSupportedError is returned.
+// Any other failure, e.g. a 550 reply for a missing file, is returned
+// as a *ProtocolError.
+func (f *Conn) SetModificationTime(file string, modTime time.Time) (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.setModificationTime(file, modTime)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) setModificationTime(file string, modTime time.Time) (*Response, error) {
+	stamp := modTime.UTC().Format(listing.MlsxTimeLayout)
+	attempts := []struct {
+		feature  string
+		cmd      string
+		expected int
+	}{
+		{"MFMT", "MFMT " + stamp + " " + file, MfmtOk},
+		{"MDTM", "MDTM " + stamp + " " + file, LastModificationTimeOk},
+		{"", "SITE UTIME " + stamp + " " + file, SiteOk},
+		{"", "SITE UTIME " + file + " " + stamp + " " + stamp + " " + stamp + " UTC", SiteOk},
+	}
+
+	for _, attempt := range attempts {
+		if attempt.feature != "" && !f.supports(attempt.feature) {
+			continue
+		}
+		response, err := f.writeCommandAndGetResponse(attempt.cmd + "\r\n")
+		if err == nil {
+			response, err = unexpectedErrorOrResponse(attempt.expected, response)
+		}
+		if err == nil {
+			return response, nil
+		}
+		code, ok := replyCode(err)
+		if ok && code == FileActionNotTaken && attempt.feature == "MDTM" {
+			// most servers only read the time with MDTM, taking the time
+			// as part of the file name: if the file exists, it's so.
+			if _, _, statErr := f.lastModificationTime(file); statErr == nil {
+				continue
+			}
+		}
+		// the other commands are rejected as a syntax error.
+		if !ok || code != SyntaxError && code != SyntaxErrorParams &&
+			code != NotImplemented && code != NotImplementedParam {
+			return nil, err
+		}
+	}
+	return nil, newFeatureNotSupportedError("MFMT, MDTM or SITE UTIME")
+}
+
 // Pwd returns the current working directory, As usual, the raw response is
 // accessible as well.
 func (f *Conn) Pwd() (*Response, string, error) {
+	return f.PwdContext(context.Background())
+}
+
+func (f *Conn) pwd() (*Response, string, error) {
 	response, err := f.writeCommandAndGetResponse("PWD\r\n")
 	if err != nil {
 		return nil, "", err
 	}
 	if response.Code != PwdOk {
-		return nil, "", newUnexpectedCodeError(PwdOk, response.Code)
+		return nil, "", newProtocolError(PwdOk, response)
 	}
 	directory, err := getPwd(response)
 	return response, directory, err
@@ -230,6 +457,10 @@ func (f *Conn) Pwd() (*Response, string, error) {
 // This operation is not atomic (requires two messages) and atomicity
 // is not handled by the library. Only the second response is returned.
 func (f *Conn) Rename(from, to string) (*Response, error) {
+	return f.RenameContext(context.Background(), from, to)
+}
+
+func (f *Conn) rename(from, to string) (*Response, error) {
 	if _, err := f.writeCommandAndGetResponse("RNFR " + from + "\r\n"); err != nil {
 		return nil, err
 	}
@@ -238,6 +469,10 @@ func (f *Conn) Rename(from, to string) (*Response, error) {
 
 // Noop issues a NOOP command.
 func (f *Conn) Noop() (*Response, error) {
+	return f.NoopContext(context.Background())
+}
+
+func (f *Conn) noop() (*Response, error) {
 	resp, err := f.writeCommandAndGetResponse("NOOP\r\n")
 	if err != nil {
 		return nil, err
@@ -245,28 +480,427 @@ func (f *Conn) Noop() (*Response, error) {
 	return unexpectedErrorOrResponse(NoopOk, resp)
 }
 
+// System returns the system type of the server, that is the first
+// word of the SYST reply, e.g. UNIX or Windows_NT. It's used to
+// pick the parser of the listings, see listing.SystemParser.
+func (f *Conn) System() (*Response, string, error) {
+	var response *Response
+	var system string
+	err := f.withContext(context.Background(), func() (err error) {
+		response, system, err = f.syst()
+		return
+	})
+	return response, system, err
+}
+
+func (f *Conn) syst() (*Response, string, error) {
+	f.systAsked = true
+	response, err := f.writeCommandAndGetResponse("SYST\r\n")
+	if err != nil {
+		return nil, "", err
+	}
+	if response.Code != SystOk {
+		return nil, "", newProtocolError(SystOk, response)
+	}
+	fields := strings.Fields(response.Msg)
+	if len(fields) == 0 {
+		return nil, "", errors.New("Fail to parse SYST response")
+	}
+	f.system = fields[0]
+	return response, f.system, nil
+}
+
+// systemType returns the system type of the server, sending
+// SYST only the first time, "" if the server doesn't tell it.
+func (f *Conn) systemType(ctx context.Context) string {
+	var system string
+	f.withContext(ctx, func() error {
+		if !f.systAsked {
+			f.syst()
+		}
+		system = f.system
+		return nil
+	})
+	return system
+}
+
+// Status returns the status of the server, sending STAT
+// without arguments. The Lines of the reply contain it.
+func (f *Conn) Status() (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.stat("")
+		return
+	})
+	return response, err
+}
+
+// StatusList lists `path`, or the current directory if empty, with
+// STAT: the listing is sent over the control connection, so that no
+// data connection is needed. Its format is the one of LIST, one line
+// per element. Some servers list only the files, not the directories.
+func (f *Conn) StatusList(path string) ([]string, error) {
+	var lines []string
+	err := f.withContext(context.Background(), func() (err error) {
+		lines, err = f.statusList(path)
+		return
+	})
+	return lines, err
+}
+
+// StatusEntries is like StatusList, but its output is
+// parsed as ListEntries does.
+func (f *Conn) StatusEntries(path string) ([]Entry, error) {
+	lines, err := f.StatusList(path)
+	if err != nil {
+		return nil, err
+	}
+	return listing.ParseSystemList(lines, f.systemType(context.Background()), time.Now())
+}
+
+func (f *Conn) stat(path string) (*Response, error) {
+	if path == "" {
+		response, err := f.writeCommandAndGetResponse("STAT\r\n")
+		if err != nil {
+			return nil, err
+		}
+		return unexpectedErrorOrResponse(StatOk, response)
+	}
+	response, err := f.writeCommandAndGetResponse("STAT " + path + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != StatDirOk && response.Code != StatFileOk && response.Code != StatOk {
+		return nil, newProtocolError(StatDirOk, response)
+	}
+	return response, nil
+}
+
+func (f *Conn) statusList(path string) ([]string, error) {
+	if path == "" {
+		// STAT without arguments is about the server.
+		path = "."
+	}
+	response, err := f.stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// the first and the last line are not part of the listing.
+	if len(response.Lines) < 3 {
+		return []string{}, nil
+	}
+	lines := make([]string, 0, len(response.Lines)-2)
+	for _, line := range response.Lines[1 : len(response.Lines)-1] {
+		lines = append(lines, strings.TrimPrefix(line, " "))
+	}
+	return lines, nil
+}
+
+// Help asks the server for help about `command`, or about every
+// command if empty. The Lines of the reply contain the text.
+func (f *Conn) Help(command string) (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.help(command)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) help(command string) (*Response, error) {
+	cmd := "HELP\r\n"
+	if command != "" {
+		cmd = "HELP " + command + "\r\n"
+	}
+	response, err := f.writeCommandAndGetResponse(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != HelpOk && response.Code != StatOk {
+		return nil, newProtocolError(HelpOk, response)
+	}
+	return response, nil
+}
+
+// Site sends SITE followed by `args`, e.g. "CHMOD 644 file".
+// The SITE commands depend on the server, so any positive
+// completion reply (2xx) is accepted.
+func (f *Conn) Site(args string) (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.site(args)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) site(args string) (*Response, error) {
+	response, err := f.writeCommandAndGetResponse("SITE " + args + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code < 200 || response.Code >= 300 {
+		return nil, newProtocolError(SiteOk, response)
+	}
+	return response, nil
+}
+
+// SiteChmod changes the permissions of `path` to `mode` with SITE CHMOD.
+func (f *Conn) SiteChmod(path string, mode os.FileMode) (*Response, error) {
+	return f.Site(fmt.Sprintf("CHMOD %o %s", mode.Perm(), path))
+}
+
+// SiteUmask sets the umask of the files created by
+// the following commands with SITE UMASK.
+func (f *Conn) SiteUmask(mask os.FileMode) (*Response, error) {
+	return f.Site(fmt.Sprintf("UMASK %03o", mask.Perm()))
+}
+
+// SiteIdle sets the time the server waits before closing
+// an idle connection with SITE IDLE, in seconds.
+func (f *Conn) SiteIdle(timeout time.Duration) (*Response, error) {
+	return f.Site(fmt.Sprintf("IDLE %d", int64(timeout/time.Second)))
+}
+
+// Allocate reserves `size` bytes of storage for the next file stored,
+// with ALLO. Most servers don't need it and reply that it's superfluous.
+func (f *Conn) Allocate(size int64) (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.allocate(size)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) allocate(size int64) (*Response, error) {
+	response, err := f.writeCommandAndGetResponse("ALLO " + strconv.FormatInt(size, 10) + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code == Superfluous {
+		return response, nil
+	}
+	return unexpectedErrorOrResponse(AlloOk, response)
+}
+
+// MountStructure mounts the file system structure `path` with SMNT,
+// few servers implement it.
+func (f *Conn) MountStructure(path string) (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.mountStructure(path)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) mountStructure(path string) (*Response, error) {
+	response, err := f.writeCommandAndGetResponse("SMNT " + path + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code == Superfluous {
+		return response, nil
+	}
+	if response.Code == SmntOk {
+		f.rememberCwd()
+	}
+	return unexpectedErrorOrResponse(SmntOk, response)
+}
+
+// Account sends the account `account` with ACCT, for the servers
+// that require it to log in, or to access some files.
+// Config.Account is sent on its own when the login requires it.
+func (f *Conn) Account(account string) (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.account(account)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) account(account string) (*Response, error) {
+	response, err := f.writeCommandAndGetResponse("ACCT " + account + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code == Superfluous {
+		return response, nil
+	}
+	if response.Code == LoginOk {
+		f.loggedIn = true
+	}
+	return unexpectedErrorOrResponse(LoginOk, response)
+}
+
+// Reinitialize sends REIN, that logs the user out and resets the
+// session without closing the control connection: Authenticate
+// logs in again. It's not allowed over TLS, since the servers
+// differ in how they reset the protection of the connection.
+func (f *Conn) Reinitialize() (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.reinitialize()
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) reinitialize() (*Response, error) {
+	if _, ok := f.control.(*tls.Conn); ok {
+		return nil, errors.New("REIN is not allowed over TLS")
+	}
+	response, err := f.writeCommandAndGetResponse("REIN\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code == ServiceNotReady {
+		// waiting for the server to be ready.
+		if response, err = f.getFtpResponse(); err != nil {
+			return nil, err
+		}
+	}
+	if response.Code != ReinOk {
+		return nil, newProtocolError(ReinOk, response)
+	}
+	// like after a new connection.
+	f.loggedIn, f.cwd = false, ""
+	f.features, f.utf8 = nil, false
+	f.serverType = ""
+	return response, nil
+}
+
+// reservedCommands are the commands refused by Command, because they
+// open a data connection or they change the state kept by Conn.
+var reservedCommands = map[string]bool{
+	"APPE": true,
+	"LIST": true,
+	"MLSD": true,
+	"NLST": true,
+	"REST": true,
+	"RETR": true,
+	"STOR": true,
+	"STOU": true,
+	"MODE": true,
+	"STRU": true,
+	"AUTH": true,
+	"CCC":  true,
+	"PBSZ": true,
+	"PROT": true,
+	"PASS": true,
+	"QUIT": true,
+	"REIN": true,
+	"USER": true,
+}
+
+// cwdCommands are the commands that change the working directory.
+var cwdCommands = map[string]bool{
+	"CDUP": true,
+	"CWD":  true,
+	"XCUP": true,
+	"XCWD": true,
+}
+
+// Command sends the command built from `format` and `args`, as
+// fmt.Sprintf does, e.g. Command("CLNT %s", name), and returns the reply.
+// It's meant for the commands not implemented by Conn: the ones about
+// a data connection (e.g. RETR, LIST and REST), the ones changing how
+// the data is transferred (MODE and STRU) and the ones changing the state
+// of the session (AUTH, CCC, PBSZ, PROT, USER, PASS, REIN and QUIT)
+// return ErrReservedCommand, the methods of Conn must be used instead. If the command, arguments
+// included, contains CR or LF, ErrInvalidCommand is returned.
+// In both cases nothing is sent.
+// The replies reporting a failure (4xx and 5xx) are returned as a
+// *ProtocolError.
+func (f *Conn) Command(format string, args ...interface{}) (*Response, error) {
+	return f.CommandExpect(nil, format, args...)
+}
+
+// CommandExpect is like Command, but the reply must have one of `codes`,
+// otherwise a *ProtocolError expecting the first of them is returned.
+// No `codes` means any code that is not a failure.
+func (f *Conn) CommandExpect(codes []int, format string, args ...interface{}) (*Response, error) {
+	cmd := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(cmd, "\r\n") {
+		return nil, ErrInvalidCommand
+	}
+	if reservedCommands[commandName(cmd)] {
+		return nil, ErrReservedCommand
+	}
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.command(codes, cmd)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) command(codes []int, cmd string) (*Response, error) {
+	response, err := f.writeCommandAndGetResponse(cmd + "\r\n")
+	// the command may have changed the type,
+	// it's sent again before the next transfer.
+	f.serverType = ""
+	if err != nil {
+		return nil, err
+	}
+	if cwdCommands[commandName(cmd)] && response.Code < 400 {
+		f.cwd = ""
+		f.rememberCwd()
+	}
+	if len(codes) == 0 {
+		if response.Code >= 400 {
+			return nil, newProtocolError(0, response)
+		}
+		return response, nil
+	}
+	for _, code := range codes {
+		if response.Code == code {
+			return response, nil
+		}
+	}
+	return nil, newProtocolError(codes[0], response)
+}
+
 // AuthSSL starts an SSL connection over the control channel.
 // Support for SSL must be explicitely turn on into config
 // with the option 'AllowSSL' AND in TLSConfig.
 // If not, SSL will fail.  This is done for security reason,
 // SSL is no longer secure, support for SSL3 must be explicitely set.
 // Note that we expect a 234 code.
+// If the control connection is already TLS-ed ErrAlreadyTLS is returned.
 func (f *Conn) AuthSSL() (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.authSSL()
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) authSSL() (*Response, error) {
+	if _, ok := f.control.(*tls.Conn); ok {
+		return nil, ErrAlreadyTLS
+	}
 	if !f.config.TLSOption.AllowSSL {
 		return nil, errors.New("Explicit support for SSL3 is required")
 	}
-	if f.config.tlsConfig.MinVersion > tls.VersionSSL30 {
+	if f.tlsConfig.MinVersion > tls.VersionSSL30 {
 		return nil, errors.New("Explicit support for SSL3 is required")
 	}
+	if features, err := f.getFeatures(); err == nil && features.Available() && !features.AuthSSL {
+		return nil, ErrNoTLS
+	}
 	response, err := f.writeCommandAndGetResponse("AUTH SSL\r\n")
 	if err != nil {
 		return nil, err
 	}
-	if response.Code != 234 {
-		return nil, errors.New(response.Error())
+	if response.Code != AuthOk {
+		return nil, newProtocolError(AuthOk, response)
 	}
 
-	f.control = tls.Client(f.control, f.config.tlsConfig)
+	f.control = tls.Client(f.control, f.tlsConfig)
 
 	tlsConn := f.control.(*tls.Conn)
 	err = tlsConn.Handshake()
@@ -276,75 +910,148 @@ func (f *Conn) AuthSSL() (*Response, error) {
 		bufio.NewReader(f.control),
 		bufio.NewWriter(f.control))
 
+	// features may change after AUTH.
+	f.features = nil
+
+	if err == nil && f.config.TLSOption.ProtectData {
+		if _, err = f.setDataProtection(ProtectionPrivate); err != nil {
+			return nil, err
+		}
+	}
+
 	return response, err
 }
 
 // AuthTLS issues an AuthTLS command.
-// If the control connection is already TLS-ed an error will be
-// thrown, containing ftp.AlreadyTLS. If failback,
-// AuthSSL will be tried.
+// If the control connection is already TLS-ed ErrAlreadyTLS
+// is returned. If failback,
+// AuthSSL will be tried. If the server has advertised its
+// features and TLS is not among them, AUTH TLS is not sent at all.
+// If the handshake fails, its error is returned and, if newConnOnFailure,
+// the control connection is replaced with a new one without TLS,
+// restoring the session as a RetryPolicy does.
 func (f *Conn) AuthTLS(failback, newConnOnFailure bool) (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.authTLS(failback, newConnOnFailure)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) authTLS(failback, newConnOnFailure bool) (*Response, error) {
+	if _, ok := f.control.(*tls.Conn); ok {
+		return nil, ErrAlreadyTLS
+	}
+	if features, err := f.getFeatures(); err == nil && features.Available() && !features.AuthTLS {
+		if failback && features.AuthSSL {
+			return f.authSSL()
+		}
+		return nil, ErrNoTLS
+	}
+
 	response, err := f.writeCommandAndGetResponse("AUTH TLS\r\n")
 	if err != nil {
 		return nil, err
 	}
 
-	if failback && response.Code != 234 { // tryssl
-		return f.AuthSSL()
+	if failback && response.Code != AuthOk { // tryssl
+		return f.authSSL()
 	}
-	if response.Code != 234 {
-		return nil, errors.New(response.Error())
+	if response.Code != AuthOk {
+		return nil, newProtocolError(AuthOk, response)
 	}
 
 	// if everything is fine...
-	f.control = tls.Client(f.control, f.config.tlsConfig)
+	f.control = tls.Client(f.control, f.tlsConfig)
 	tlsConn := f.control.(*tls.Conn)
 	err = tlsConn.Handshake()
 
 	if err != nil {
-		// keeping the 'old' connection
-		// so really nothing to do.
-		f.Quit()
-		newPort, _, _ := f.getRandomPort()
-		host := strings.Split(f.control.LocalAddr().String(), ":")[0]
+		// the control connection is not usable anymore, a new
+		// one without TLS is opened if required.
+		if !newConnOnFailure {
+			f.control.Close()
+		} else if reconnectErr := f.reconnect(context.Background(), false); reconnectErr != nil {
+			return nil, reconnectErr
+		}
+		return nil, err
+	}
 
-		remote := f.control.RemoteAddr().String()
+	// creating the new reader from the
+	// TLS connection.
+	f.controlRw = bufio.NewReadWriter(
+		bufio.NewReader(f.control),
+		bufio.NewWriter(f.control),
+	)
 
-		var ips []net.IP
-		var newErr error
-		var newConn *Conn
+	// features may change after AUTH.
+	f.features = nil
 
-		ips, newErr = net.LookupIP(host)
-		if newErr != nil {
+	if f.config.TLSOption.ProtectData {
+		if _, err = f.setDataProtection(ProtectionPrivate); err != nil {
 			return nil, err
 		}
-		newConfig := f.config
-		newConfig.LocalIP = ips[0]
-		newConfig.LocalPort = newPort
-
-		newConn, _, newErr = DialAndAuthenticate(remote, newConfig)
-		if newErr != nil {
-			return nil, newErr
-		}
-		newControl := newConn.control
-		f.control = newControl
-		f.controlRw = bufio.NewReadWriter(
-			bufio.NewReader(f.control),
-			bufio.NewWriter(f.control),
-		)
-
-	} else {
-		// creating the new reader from the
-		// TLS connection.
-		f.controlRw = bufio.NewReadWriter(
-			bufio.NewReader(f.control),
-			bufio.NewWriter(f.control),
-		)
 	}
 
 	return response, err
 }
 
+// SetDataProtection sets the protection level of the data connections,
+// issuing PBSZ 0 followed by PROT. The control connection must
+// already be TLS-ed. See https://tools.ietf.org/html/rfc4217#section-9
+func (f *Conn) SetDataProtection(level ProtectionLevel) (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.setDataProtection(level)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) setDataProtection(level ProtectionLevel) (*Response, error) {
+	if _, ok := f.control.(*tls.Conn); !ok {
+		return nil, errors.New("Data protection requires a TLS control connection")
+	}
+	if !f.supports("PROT") {
+		return nil, newFeatureNotSupportedError("PROT")
+	}
+
+	response, err := f.writeCommandAndGetResponse("PBSZ 0\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != PbszOk {
+		return nil, newProtocolError(PbszOk, response)
+	}
+
+	response, err = f.writeCommandAndGetResponse("PROT " + string(level) + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != ProtOk {
+		return nil, newProtocolError(ProtOk, response)
+	}
+
+	f.protection = level
+	return response, nil
+}
+
+// DataProtection returns the protection level currently
+// used for data connections.
+func (f *Conn) DataProtection() ProtectionLevel {
+	return f.protection
+}
+
+// LastDataConnectionState returns the TLS state of the data connection used
+// by the last transfer, or nil if it wasn't protected. DidResume tells
+// whether the TLS session of the control connection has been resumed.
+// Note that only session tickets are supported, so servers relying on
+// session IDs will never be resumed.
+func (f *Conn) LastDataConnectionState() *tls.ConnectionState {
+	return f.lastDataTLSState
+}
+
 // StoreSimple is a simplified version of function Store which does not
 // involves the use of channels, so it's suitable for uses when is not necessary
 // to do an 'async' uploading.
@@ -409,6 +1116,7 @@ func (f *Conn) RetrSimple(
 // If you want to delete the file if an abort happens, set `true` to `deleteIfAbort`.
 // `bufferSize` is the optional custom buffer size to use for the transfer. Pass 0 to not care
 // about it.
+// StoreContext is a simpler alternative that doesn't involve channels.
 func (f *Conn) Store(
 	mode Mode,
 	src string,
@@ -463,6 +1171,8 @@ func (f *Conn) Store(
 
 // TODO see args order.
 // Retrieve download a file located.
+// RetrieveContext is a simpler alternative that doesn't involve channels,
+// and it can resume a partial download, see TransferOptions.
 func (f *Conn) Retrieve(mode Mode,
 	filepathSrc,
 	filepathDest string,
@@ -485,3 +1195,289 @@ func (f *Conn) Retrieve(mode Mode,
 		bufferSize,
 	)
 }
+
+// StoreFrom loads everything is read from `r` into the remote file `dst`,
+// until r returns io.EOF.
+// The transfer is aborted when `ctx` is done, in that case the
+// error of the context is returned.
+func (f *Conn) StoreFrom(ctx context.Context, mode Mode, dst string, r io.Reader) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+	t := &transfer{ctx: ctx}
+	err := f.retry(ctx, func() error {
+		return f.storeFrom(mode, "STOR "+dst+"\r\n", r, t)
+	}, t.notStarted)
+	if err == errAborted {
+		return f.abortError(t)
+	}
+	return err
+}
+
+// RetrieveTo downloads the remote file `src` writing it into `w`.
+// The transfer is aborted when `ctx` is done, in that case the
+// error of the context is returned.
+func (f *Conn) RetrieveTo(ctx context.Context, mode Mode, src string, w io.Writer) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+	t := &transfer{ctx: ctx}
+	err := f.retry(ctx, func() error {
+		return f.retrieveTo(mode, "RETR "+src+"\r\n", w, t)
+	}, func() bool {
+		if !t.started {
+			return true
+		}
+		if !f.supportsRestStream() || f.transferType(t) == TypeASCII {
+			return false
+		}
+		// restarting from the last byte received.
+		t.offset += t.transferred
+		t.started, t.transferred = false, 0
+		return true
+	})
+	if err == errAborted {
+		return f.abortError(t)
+	}
+	return err
+}
+
+// OpenRead starts the download of `path` and returns the data connection
+// the file can be read from. The connection uses the default mode.
+// Other commands, Quit included, wait until the returned reader is closed:
+// Close reads the final reply of the server, aborting the transfer
+// if the file has not been read until io.EOF.
+func (f *Conn) OpenRead(path string) (io.ReadCloser, error) {
+	f.acquire(context.Background())
+	var conn net.Conn
+	err := f.retry(context.Background(), func() (err error) {
+		if err = f.ensureType(f.transferType(&transfer{})); err != nil {
+			return
+		}
+		conn, err = f.openDataConn(context.Background(), IndMode, "RETR "+path+"\r\n", 0)
+		return
+	}, nil)
+	if err != nil {
+		f.release()
+		return nil, err
+	}
+	reader := &dataReader{ftpConn: f, conn: conn}
+	if f.serverType == TypeASCII {
+		return struct {
+			io.Reader
+			io.Closer
+		}{newLineReader(reader, &toLF{}), reader}, nil
+	}
+	return reader, nil
+}
+
+// OpenWrite starts the upload of `path` and returns the data connection
+// the file can be written to. The connection uses the default mode.
+// Other commands, Quit included, wait until the returned writer is closed:
+// Close tells the server the file is complete and reads its final reply.
+func (f *Conn) OpenWrite(path string) (io.WriteCloser, error) {
+	f.acquire(context.Background())
+	var conn net.Conn
+	err := f.retry(context.Background(), func() (err error) {
+		if err = f.ensureType(f.transferType(&transfer{})); err != nil {
+			return
+		}
+		conn, err = f.openDataConn(context.Background(), IndMode, "STOR "+path+"\r\n", 0)
+		return
+	}, nil)
+	if err != nil {
+		f.release()
+		return nil, err
+	}
+	writer := &dataWriter{ftpConn: f, conn: conn}
+	if f.serverType == TypeASCII {
+		return struct {
+			io.Writer
+			io.Closer
+		}{newLineWriter(writer, &toCRLF{}), writer}, nil
+	}
+	return writer, nil
+}
+
+// StoreContext loads the file `src` to `dst`, it's the context-based
+// version of Store. When `ctx` is done, or the connection is closed
+// with Quit, the transfer is aborted and the error of the context
+// is returned. The deadline of `ctx`, if any, applies to both the
+// control and the data connection. `opts` can be nil.
+func (f *Conn) StoreContext(ctx context.Context, mode Mode, src, dst string, opts *TransferOptions) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+	t := newTransfer(ctx, opts)
+	err := f.retry(ctx, func() error {
+		return f.storeFile(mode, src, dst, t)
+	}, func() bool {
+		if t.started {
+			// continuing from the size of the remote file,
+			// otherwise STOR truncates it.
+			t.resume = t.resume || f.transferType(t) == TypeBinary
+		}
+		t.started, t.transferred = false, 0
+		return true
+	})
+	if err == errAborted {
+		return f.abortError(t)
+	}
+	return err
+}
+
+// AppendContext is like StoreContext, but the local file `src` is appended
+// to `dst` using APPE. If `dst` doesn't exist, it's created.
+func (f *Conn) AppendContext(ctx context.Context, mode Mode, src, dst string, opts *TransferOptions) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+	t := newTransfer(ctx, opts)
+	t.appendOnly = true
+	err := f.retry(ctx, func() error {
+		return f.storeFile(mode, src, dst, t)
+	}, t.notStarted)
+	if err == errAborted {
+		return f.abortError(t)
+	}
+	return err
+}
+
+// AppendFrom is like StoreFrom, but what is read from `r` is appended
+// to `dst` using APPE. If `dst` doesn't exist, it's created.
+func (f *Conn) AppendFrom(ctx context.Context, mode Mode, dst string, r io.Reader) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+	t := &transfer{ctx: ctx}
+	err := f.retry(ctx, func() error {
+		return f.storeFrom(mode, "APPE "+dst+"\r\n", r, t)
+	}, t.notStarted)
+	if err == errAborted {
+		return f.abortError(t)
+	}
+	return err
+}
+
+// RetrieveContext downloads the file `src` to `dst`, it's the context-based
+// version of Retrieve. When `ctx` is done, or the connection is closed
+// with Quit, the transfer is aborted, the local file is removed and the
+// error of the context is returned. The deadline of `ctx`, if any, applies
+// to both the control and the data connection. `opts` can be nil.
+func (f *Conn) RetrieveContext(ctx context.Context, mode Mode, src, dst string, opts *TransferOptions) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+	t := newTransfer(ctx, opts)
+	err := f.retry(ctx, func() error {
+		return f.retrieveFile(mode, src, dst, t)
+	}, func() bool {
+		if t.started {
+			// continuing from the size of the local file, if possible,
+			// otherwise the local file is truncated.
+			t.resume = t.resume || f.supportsRestStream() && f.transferType(t) == TypeBinary
+		}
+		t.started, t.transferred = false, 0
+		return true
+	})
+	if err == errAborted {
+		return f.abortError(t)
+	}
+	return err
+}
+
+// ListContext performs a LIST on `path`, or on the current directory
+// if `path` is empty, and returns one row per item.
+// It's the context-based version of LsDir.
+func (f *Conn) ListContext(ctx context.Context, mode Mode, path string) ([]string, error) {
+	if err := f.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.release()
+	var lines []string
+	err := f.retry(ctx, func() (err error) {
+		lines, err = f.list(ctx, mode, path)
+		return
+	}, nil)
+	return lines, err
+}
+
+// CdContext is the context-based version of Cd.
+// If `ctx` is done while waiting for the reply, the control
+// connection is left in an unknown state and should be closed,
+// this is true for every context-based command.
+func (f *Conn) CdContext(ctx context.Context, path string) (*Response, error) {
+	var response *Response
+	err := f.withContext(ctx, func() (err error) {
+		response, err = f.cd(path)
+		return
+	})
+	return response, err
+}
+
+// PwdContext is the context-based version of Pwd.
+func (f *Conn) PwdContext(ctx context.Context) (*Response, string, error) {
+	var response *Response
+	var directory string
+	err := f.withContext(ctx, func() (err error) {
+		response, directory, err = f.pwd()
+		return
+	})
+	return response, directory, err
+}
+
+// MkDirContext is the context-based version of MkDir.
+func (f *Conn) MkDirContext(ctx context.Context, name string) (*Response, error) {
+	var response *Response
+	err := f.withContext(ctx, func() (err error) {
+		response, err = f.mkDir(name)
+		return
+	})
+	return response, err
+}
+
+// DeleteDirContext is the context-based version of DeleteDir.
+func (f *Conn) DeleteDirContext(ctx context.Context, name string) (*Response, error) {
+	var response *Response
+	err := f.withContext(ctx, func() (err error) {
+		response, err = f.deleteDir(name)
+		return
+	})
+	return response, err
+}
+
+// DeleteFileContext is the context-based version of DeleteFile.
+func (f *Conn) DeleteFileContext(ctx context.Context, filepath string) (*Response, error) {
+	var response *Response
+	err := f.withContext(ctx, func() (err error) {
+		response, err = f.deleteFile(filepath)
+		return
+	})
+	return response, err
+}
+
+// RenameContext is the context-based version of Rename.
+func (f *Conn) RenameContext(ctx context.Context, from, to string) (*Response, error) {
+	var response *Response
+	err := f.withContext(ctx, func() (err error) {
+		response, err = f.rename(from, to)
+		return
+	})
+	return response, err
+}
+
+// NoopContext is the context-based version of Noop.
+func (f *Conn) NoopContext(ctx context.Context) (*Response, error) {
+	var response *Response
+	err := f.withContext(ctx, func() (err error) {
+		response, err = f.noop()
+		return
+	})
+	return response, err
+}
@@ -18,6 +18,7 @@ package ftp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -28,33 +29,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
-)
-
-// func (r *Response) IsAborted() bool {
-// 	return r.Code == 426
-// }
 
-// func (r *Response) IsSuccesfullyCompleted() bool {
-// 	return r.Code == 226
-// }
-//
-// func (r *Response) IsNotImplemented() bool {
-// 	return r.Code == 502
-// }
-//
-// // IsFailToAccomplish checks if response.Code == 550.
-// // 550 is an error used when the server can parse our
-// // request but can't serve it. For example when we request a
-// // size for a set transfer mode which the file can't be sent over.
-// // Another example is where modification time is not available.
-// func (r *Response) IsFailToAccomplish() bool {
-// 	return r.Code == 550
-// }
-//
-// func (r *Response) IsNotSupported() bool {
-// 	return r.Code == 431
-// }
-//
+	"github.com/nbena/ftp/listing"
+)
 
 // IsFtpError returns true if the response represents
 // an error. That means that the code is >=500 && < 600.
@@ -62,68 +39,87 @@ func (r *Response) IsFtpError() bool {
 	return (r.Code >= 500 && r.Code < 600) || r.Code == FileUnavailable
 }
 
-//
-// // IsFileNotExists check if the code is 450.
-// func (r *Response) IsFileNotExists() bool {
-// 	return r.Code == 450
-// }
-
 func (r *Response) getTime() (*time.Time, error) {
-	var year, month, day, hour, min, sec, nsec int
-
-	// scanf has been taken from the linux ftp
-	// client source code.
-	parsed, err := fmt.Sscanf(r.Msg,
-		"%04d%02d%02d%02d%02d%02d.%03d",
-		&year, &month, &day, &hour, &min, &sec, &nsec)
+	// the fraction of second is optional, see
+	// https://tools.ietf.org/html/rfc3659#section-2.3
+	date, err := time.Parse(listing.MlsxTimeLayout, strings.TrimSpace(r.Msg))
 	if err != nil {
-		return nil, err
-	}
-	// if we can't parse nsec is ok
-	if parsed == 6 {
-		nsec = 0
-	}
-	if parsed < 6 {
 		return nil, fmt.Errorf("Fail to parse date: %s", r.Msg)
 	}
-
-	date := time.Date(year, time.Month(month), day, hour, min, sec, nsec, time.UTC)
 	return &date, nil
 }
 
 func (f *Conn) getFtpResponse() (*Response, error) {
-	// response, err := f.responseString()
-
-	//reader := bufio.NewReader(f.control)
-
-	// buf := make([]byte, 1024)
-	// n, err := f.control.Read(buf)
-	// response := string(buf[:n])
-
-	// buff, _, err := f.controlReader.ReadLine()
-	buff, _, err := f.controlRw.ReadLine()
-
-	// fmt.Printf("I read: %d", n)
-
-	//fmt.Fprint(f.config.ResponseFile, response)
-
+	ftpResponse, err := f.readResponse()
 	if err != nil {
 		return nil, err
 	}
+	if ftpResponse.IsFtpError() {
+		return nil, newProtocolError(0, ftpResponse)
+	}
+	return ftpResponse, nil
+}
 
-	response := string(buff)
+// readResponse reads a whole reply from the control connection.
+// Multi-line replies are handled according to RFC 959, that is:
+// the first line is in the form `<code>-<text>`, and the reply
+// goes on until a line `<code> <text>` with the same code is found.
+// Lines in between are collected as they are, except for the
+// `<code>-` prefix that some servers repeat on every line.
+func (f *Conn) readResponse() (*Response, error) {
+	line, err := f.readLine()
+	if err != nil {
+		return nil, err
+	}
 
-	ftpResponse, err := newFtpResponse(response)
+	ftpResponse, err := newFtpResponse(line)
 	if err != nil {
 		return nil, err
 	}
-	if ftpResponse.IsFtpError() {
-		return nil, errors.New(ftpResponse.Error())
+	ftpResponse.command = f.lastCommand
+
+	if len(line) < 4 || line[3] != '-' {
+		return ftpResponse, nil
 	}
-	return ftpResponse, nil
+
+	code := line[0:3]
+	for {
+		line, err = f.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == code || strings.HasPrefix(line, code+" ") {
+			// last line.
+			ftpResponse.Lines = append(ftpResponse.Lines, strings.TrimPrefix(line, code+" "))
+			return ftpResponse, nil
+		}
+		ftpResponse.Lines = append(ftpResponse.Lines, strings.TrimPrefix(line, code+"-"))
+	}
+}
+
+// readLine reads a single line from the control connection,
+// stripping the line terminator.
+func (f *Conn) readLine() (string, error) {
+	expired := f.watchReply()
+	line, err := f.controlRw.ReadString('\n')
+	if expired() && err != nil {
+		return "", newTimeoutError(TimeoutCommand, f.config.CommandTimeout, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
+// writeCommand writes `cmd` and records its name,
+// the following replies are about it.
 func (f *Conn) writeCommand(cmd string) error {
+	f.lastCommand = commandName(cmd)
+	return f.writeLine(cmd)
+}
+
+func (f *Conn) writeLine(cmd string) error {
 	f.controlRw.Flush()
 
 	// we try ascii.
@@ -148,12 +144,80 @@ func (f *Conn) writeCommandAndGetResponse(cmd string) (*Response, error) {
 	return f.getFtpResponse()
 }
 
+// aLongTimeAgo is a deadline in the past, used to
+// unblock any pending I/O on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch applies the deadline of ctx using `setDeadline`, and
+// unblocks any pending I/O as soon as ctx is done.
+// The returned function stops watching and clears
+// the deadline, it must always be called.
+func watch(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		// never done, e.g. context.Background().
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		setDeadline(deadline)
+	}
+
+	stopChan := make(chan struct{})
+	stoppedChan := make(chan struct{})
+	go func() {
+		defer close(stoppedChan)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-stopChan:
+		}
+	}()
+
+	return func() {
+		close(stopChan)
+		<-stoppedChan
+		setDeadline(time.Time{})
+	}
+}
+
+// withContext runs `exchange` holding the lock of the control
+// connection, and watching the control connection with ctx.
+// Only reads are interrupted: if ctx is done while waiting for a reply
+// the control connection is left in an unknown state and should be closed.
+// `exchange` is retried according to the RetryPolicy of the config.
+func (f *Conn) withContext(ctx context.Context, exchange func() error) error {
+	if err := f.acquire(ctx); err != nil {
+		return err
+	}
+	defer f.release()
+
+	err := f.retry(ctx, func() error {
+		return f.watched(ctx, exchange)
+	}, nil)
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// watched runs `exchange` watching the control connection with ctx.
+func (f *Conn) watched(ctx context.Context, exchange func() error) error {
+	stop := watch(ctx, f.control.SetReadDeadline)
+	defer stop()
+	return exchange()
+}
+
 // newFtpResponse builds a Response object from a string,
 // the string should be build in the following way:
 // <code> <message>; <message> can be omitted.
+// Lines too short or not starting with a three digits code
+// are reported as an error.
 func newFtpResponse(response string) (*Response, error) {
-	code, err := strconv.Atoi(response[0:3])
+	if len(response) < 3 || !isReplyCode(response[0:3]) {
+		return nil, fmt.Errorf("Fail to parse response: %q", response)
+	}
 
+	code, err := strconv.Atoi(response[0:3])
 	if err != nil {
 		return nil, err
 	}
@@ -168,7 +232,17 @@ func newFtpResponse(response string) (*Response, error) {
 	// msg = strings.TrimRight(msg, "\r")
 	// msg = strings.TrimRight(msg, "\n")
 
-	return &Response{Code: code, Msg: msg}, nil
+	return &Response{Code: code, Msg: msg, Lines: []string{msg}}, nil
+}
+
+// isReplyCode returns true if s is made of digits only.
+func isReplyCode(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
 }
 
 // func inverseResponse(response string) *Response {
@@ -216,6 +290,27 @@ func parsePasv(response *Response) (*net.TCPAddr, error) {
 	}, nil
 }
 
+// parseEpsv parses the EPSV response, which is in the form
+// `229 Entering Extended Passive Mode (|||6446|)`, where '|'
+// can be any delimiter. Only the port is sent by the server.
+func parseEpsv(response *Response) (int, error) {
+	start := strings.Index(response.Msg, "(")
+	end := strings.LastIndex(response.Msg, ")")
+	if start == -1 || end < start+1 {
+		return 0, errors.New("Fail to parse EPSV response")
+	}
+	addr := response.Msg[start+1 : end]
+	members := strings.Split(addr, addr[0:1])
+	if len(members) != 5 {
+		return 0, errors.New("Fail to parse EPSV response")
+	}
+	port, err := strconv.Atoi(members[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.New("Fail to parse EPSV port")
+	}
+	return port, nil
+}
+
 // CipherSuitesString shows the list of available ciphers.
 // If allowWeakHash is set (we strongly suggest to no)
 // ciphers with SHA are permitted. We don't permit
@@ -278,7 +373,10 @@ func cipherSuites(allowWeakHash bool) []uint16 {
 	return basicCipherSuites
 }
 
-func (c *Config) initTLS() {
+// tlsConfigs returns the TLS configuration of the control connection
+// to `remote`, and the one of its data connections. They're built for
+// each connection, so that every one of them has its own session cache.
+func (c *Config) tlsConfigs(remote string) (*tls.Config, *tls.Config) {
 	if c.TLSOption == nil {
 		c.TLSOption = &TLSOption{
 			AllowSSL:       false,
@@ -289,49 +387,111 @@ func (c *Config) initTLS() {
 	}
 
 	// if c.TLSOption.AllowSSL || c.TLSOption.ImplicitTLS || c.TLSOption.AuthTLSOnFirst {
-	c.tlsConfig = &tls.Config{}
+	tlsConfig := &tls.Config{}
 	//}
 
 	if c.TLSOption.AllowSSL {
-		c.tlsConfig.MinVersion = tls.VersionSSL30
+		tlsConfig.MinVersion = tls.VersionSSL30
 	} else if c.TLSOption.ImplicitTLS || c.TLSOption.AuthTLSOnFirst {
-		if c.tlsConfig.MinVersion <= tls.VersionSSL30 {
-			c.tlsConfig.MinVersion = tls.VersionTLS12
+		if tlsConfig.MinVersion <= tls.VersionSSL30 {
+			tlsConfig.MinVersion = tls.VersionTLS12
 		}
 	}
 
 	if c.TLSOption.SkipVerify {
-		c.tlsConfig.InsecureSkipVerify = true
+		tlsConfig.InsecureSkipVerify = true
 	} else {
-		c.tlsConfig.InsecureSkipVerify = false
+		tlsConfig.InsecureSkipVerify = false
+	}
+
+	tlsConfig.ServerName = c.TLSOption.ServerName
+	if tlsConfig.ServerName == "" {
+		// as tls.Dial does. It is required for the session
+		// cache too, otherwise sessions are keyed by the remote
+		// address, whose port differs on every data connection.
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			tlsConfig.ServerName = host
+		}
 	}
 
-	c.tlsConfig.ServerName = c.TLSOption.ServerName
+	tlsConfig.CipherSuites = cipherSuites(c.TLSOption.AllowWeakHash)
 
-	c.tlsConfig.CipherSuites = cipherSuites(c.TLSOption.AllowWeakHash)
+	// Data connections must resume the session of the control
+	// connection, many servers refuse them otherwise. They share
+	// the cache, but they can't replace the control session.
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	dataTLSConfig := tlsConfig.Clone()
+	dataTLSConfig.ClientSessionCache = &readOnlySessionCache{
+		cache: tlsConfig.ClientSessionCache,
+	}
+	return tlsConfig, dataTLSConfig
+}
+
+// readOnlySessionCache is a tls.ClientSessionCache that
+// never stores sessions.
+type readOnlySessionCache struct {
+	cache tls.ClientSessionCache
+}
+
+func (c *readOnlySessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(sessionKey)
+}
+
+func (c *readOnlySessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {}
+
+func internalDial(ctx context.Context, remote string, config *Config) (*Conn, *Response, error) {
+	dialCtx, cancel := withTimeout(ctx, config.DialTimeout)
+	defer cancel()
+	conn, response, err := dialConn(dialCtx, remote, config)
+	return conn, response, timeoutError(ctx, dialCtx, TimeoutDial, config.DialTimeout, err)
+}
+
+// localDialIP returns the IP to bind the control connection to:
+// `ip` is used only if its family matches the one of `remote`,
+// otherwise the dial would fail, and the system picks the address.
+// A remote host name is resolved later by the dialer, so in that
+// case `ip` is used as is.
+func localDialIP(ip net.IP, remote string) net.IP {
+	if ip == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return ip
+	}
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return ip
+	}
+	if (ip.To4() == nil) != (remoteIP.To4() == nil) {
+		return nil
+	}
+	return ip
 }
 
-func internalDial(remote string, config *Config) (*Conn, *Response, error) {
+func dialConn(ctx context.Context, remote string, config *Config) (*Conn, *Response, error) {
 	var conn net.Conn
 	var err error
 
 	dialer := &net.Dialer{
 		LocalAddr: &net.TCPAddr{
-			IP:   config.LocalIP,
+			IP:   localDialIP(config.LocalIP, remote),
 			Port: config.LocalPort,
 		},
+		KeepAlive: config.KeepAlive,
 	}
 
 	if config.DefaultMode == IndMode {
 		return nil, nil, errors.New(InvalidMode)
 	}
 
-	config.initTLS()
+	tlsConfig, dataTLSConfig := config.tlsConfigs(remote)
 
 	if config.TLSOption.ImplicitTLS {
-		conn, err = tls.DialWithDialer(dialer, "tcp", remote, config.tlsConfig)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", remote)
 	} else {
-		conn, err = dialer.Dial("tcp", remote)
+		conn, err = dialer.DialContext(ctx, "tcp", remote)
 	}
 
 	if err != nil {
@@ -339,40 +499,58 @@ func internalDial(remote string, config *Config) (*Conn, *Response, error) {
 	}
 
 	ftpConn := &Conn{
-		control:    conn,
-		config:     config,
-		bufferSize: bufferSize,
+		control:       conn,
+		remote:        remote,
+		config:        config,
+		tlsConfig:     tlsConfig,
+		dataTLSConfig: dataTLSConfig,
+		bufferSize:    bufferSize,
+		protection:    ProtectionClear,
+		lastUsed:      time.Now(),
 	}
 	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
 	ftpConn.controlRw = bufio.NewReadWriter(reader, writer)
 
 	ftpConn.ctx, ftpConn.cancel = context.WithCancel(context.Background())
 
+	// the dial context bounds the greeting and the TLS negotiation as well.
+	defer watch(ctx, conn.SetReadDeadline)()
+
 	response, err := ftpConn.getFtpResponse()
 	if err != nil {
 		return nil, nil, err
 	}
 	if response.Code != FirstConnOk {
-		return nil, nil, newUnexpectedCodeError(FirstConnOk, response.Code)
+		return nil, nil, newProtocolError(FirstConnOk, response)
 	}
 
-	// always try tls.
-	var tlsResponse *Response
-	if config.TLSOption.AuthTLSOnFirst {
-		tlsResponse, err = ftpConn.AuthTLS(true, true)
-		if err != nil {
+	if config.TLSOption.ImplicitTLS && config.TLSOption.ProtectData {
+		if _, err = ftpConn.SetDataProtection(ProtectionPrivate); err != nil {
 			return nil, nil, err
 		}
+	}
 
-		if tlsResponse.Code == NotSupported {
+	// always try tls, unless it's already on.
+	var tlsResponse *Response
+	if config.TLSOption.AuthTLSOnFirst && !config.TLSOption.ImplicitTLS {
+		tlsResponse, err = ftpConn.AuthTLS(true, true)
+		if err != nil {
+			// FEAT may have told us there's no TLS at all.
+			if !errors.Is(err, ErrNoTLS) || !config.TLSOption.ContinueIfNoSSL {
+				return nil, nil, err
+			}
+		} else if tlsResponse.Code == NotSupported {
 			if config.TLSOption.ContinueIfNoSSL {
-				err = errors.New(FailToTLS)
+				err = ErrNoTLS
 			} else {
-				return nil, nil, errors.New(FailToTLS)
+				return nil, nil, ErrNoTLS
 			}
 		}
 	}
 
+	if config.KeepAlive > 0 || config.IdleTimeout > 0 {
+		go ftpConn.keepAlive()
+	}
 	return ftpConn, response, err
 }
 
@@ -390,15 +568,20 @@ func (f *Conn) port( /*ip net.IP*/ ) (*Response, int, error) {
 	// }
 	// f.listenersParams.Enqueue(&port)
 
+	ip := f.localIP().To4()
+	if ip == nil {
+		return nil, 0, errors.New("PORT requires an IPv4 address, use EPRT")
+	}
+
 	//writing command to the server.
-	f.writeCommand("PORT " + portString(f.config.LocalIP, n1, n2) + "\r\n")
+	f.writeCommand("PORT " + portString(ip, n1, n2) + "\r\n")
 	response, err := f.getFtpResponse()
 	if err != nil {
 		return nil, 0, err
 	}
 
 	if response.Code != PortOk {
-		return nil, 0, newUnexpectedCodeError(PortOk, response.Code)
+		return nil, 0, newProtocolError(PortOk, response)
 	}
 
 	//if ok adding the listener to the listeners list
@@ -406,17 +589,85 @@ func (f *Conn) port( /*ip net.IP*/ ) (*Response, int, error) {
 	return response, port, nil
 }
 
-func (f *Conn) openListener() (net.Listener, error) {
+// eprt runs the EPRT command on the local IP, that works with
+// IPv6 too. supported is false if the server doesn't implement it.
+func (f *Conn) eprt() (response *Response, port int, supported bool, err error) {
+	port, _, _ = f.getRandomPort()
+
+	if err = f.writeCommand("EPRT " + eprtString(f.localIP(), port) + "\r\n"); err != nil {
+		return nil, 0, true, err
+	}
+	response, err = f.readResponse()
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	if isExtendedModeRefused(response) {
+		return nil, 0, false, nil
+	}
+	if response.Code != EprtOk {
+		return nil, 0, true, newProtocolError(EprtOk, response)
+	}
+	return response, port, true, nil
+}
+
+// localIP returns the IP used for active connections, which is
+// the configured one, if of the right family, or the control connection one.
+func (f *Conn) localIP() net.IP {
+	ip := localDialIP(f.config.LocalIP, f.control.RemoteAddr().String())
+	if ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	return f.control.LocalAddr().(*net.TCPAddr).IP
+}
+
+// isIPv6 returns true if the control connection is over IPv6,
+// in this case only the extended modes can be used.
+func (f *Conn) isIPv6() bool {
+	addr, ok := f.control.RemoteAddr().(*net.TCPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+// isNotImplemented returns true if the response tells that
+// the server doesn't implement (or recognize) the command.
+func isNotImplemented(response *Response) bool {
+	return response.Code == NotImplemented || response.Code == SyntaxError
+}
+
+// isExtendedModeRefused returns true if the response to EPRT or EPSV
+// tells that the server can't use the extended modes, so that the
+// client has to fall back to PORT or PASV.
+func isExtendedModeRefused(response *Response) bool {
+	return isNotImplemented(response) || response.Code == NetworkProtocolNotSupported
+}
+
+func (f *Conn) openListener(extended bool) (net.Listener, error) {
 	var listener net.Listener
+	var port int
 	var err error
-	_, port, err := f.port()
-	if err != nil {
-		return nil, err
+
+	supported := false
+	if extended && !f.noExtendedModes && f.supports("EPRT") {
+		_, port, supported, err = f.eprt()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !supported {
+		if f.isIPv6() {
+			return nil, newFeatureNotSupportedError("EPRT")
+		}
+		if extended {
+			f.noExtendedModes = true
+		}
+		if _, port, err = f.port(); err != nil {
+			return nil, err
+		}
 	}
 	// log.Printf("PORT OK")
 	// opening the listener.
 	// port := f.listenersParams.Dequeue().(*int)
-	listener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", f.config.LocalIP.String(), port))
+	listener, err = net.Listen("tcp", net.JoinHostPort(f.localIP().String(), strconv.Itoa(port)))
 	// log.Printf("Listener Ok")
 	if err != nil {
 		return nil, err
@@ -424,97 +675,252 @@ func (f *Conn) openListener() (net.Listener, error) {
 	return listener, nil
 }
 
-func (f *Conn) internalLs(mode Mode, filepath string, doneChan chan<- []string, errChan chan<- error) {
-
-	var receiver io.Reader
-	var cmd string
+// dataMode returns the mode to use for a data connection: IndMode
+// means the default mode, and on IPv6 the extended modes are always used.
+func (f *Conn) dataMode(mode Mode) Mode {
+	if mode == IndMode {
+		mode = f.config.DefaultMode
+	}
+	if f.isIPv6() {
+		if mode == ActiveMode {
+			mode = ExtendedActiveMode
+		} else if mode == PassiveMode {
+			mode = ExtendedPassiveMode
+		}
+	}
+	return mode
+}
 
-	if filepath == "" {
-		cmd = "LIST\r\n"
-	} else {
-		cmd = "LIST " + filepath + "\r\n"
+// openDataConn opens the data connection using the given mode,
+// sending `cmd` over the control channel. In passive mode the
+// connection is established before sending the command, because
+// some servers wait for it before replying.
+// If data protection is on, the returned connection is TLS-ed.
+// `ctx` bounds the whole setup, both on the control and on the
+// data connection. If `offset` is not 0, a REST is sent before `cmd`.
+func (f *Conn) openDataConn(ctx context.Context, mode Mode, cmd string, offset int64) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	if mode == IndMode {
-		mode = f.config.DefaultMode
+	dataCtx, cancel := withTimeout(ctx, f.config.DataConnTimeout)
+	defer cancel()
+
+	stop := watch(dataCtx, f.control.SetReadDeadline)
+	conn, err := f.dialDataConn(dataCtx, mode, cmd, offset)
+	stop()
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
+	return conn, timeoutError(ctx, dataCtx, TimeoutDataConn, f.config.DataConnTimeout, err)
+}
+
+func (f *Conn) dialDataConn(ctx context.Context, mode Mode, cmd string, offset int64) (net.Conn, error) {
+	var conn net.Conn
 
-	if mode == ActiveMode {
+	mode = f.dataMode(mode)
 
-		// create the listener.
-		listener, err := f.openListener()
+	switch mode {
+	case ActiveMode, ExtendedActiveMode:
+		listener, err := f.openListener(mode == ExtendedActiveMode)
 		if err != nil {
-			errChan <- err
-			return
+			return nil, err
 		}
 		defer listener.Close()
 
-		// sending command.
-		response, err := f.writeCommandAndGetResponse(cmd)
-		if err != nil {
-			errChan <- err
-			return
+		if _, err = f.transferCommand(cmd, offset); err != nil {
+			return nil, err
 		}
 
-		if response.Code == FileUnavailable {
-			errChan <- errors.New(response.String())
-			return
+		if tcpListener, ok := listener.(*net.TCPListener); ok {
+			defer watch(ctx, tcpListener.SetDeadline)()
 		}
-
-		// accept connection
-		receiver, err = listener.Accept()
+		conn, err = listener.Accept()
 		if err != nil {
-			errChan <- err
-			return
+			return nil, err
 		}
-
-	} else if mode == PassiveMode {
-
-		addr, err := f.pasvGetAddr()
+	case PassiveMode, ExtendedPassiveMode:
+		addr, err := f.passiveAddr(mode == ExtendedPassiveMode)
 		if err != nil {
-			errChan <- err
-			return
-		}
-		// write command
-		if _, err = f.writeCommandAndGetResponse(cmd); err != nil {
-			errChan <- err
-			return
+			return nil, err
 		}
 
-		receiver, err = f.connectToAddr(addr)
+		conn, err = f.connectToAddr(ctx, addr)
 		if err != nil {
-			errChan <- err
-			return
+			return nil, err
 		}
+
+		if _, err = f.transferCommand(cmd, offset); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	default:
+		return nil, errors.New(InvalidMode)
 	}
 
-	buffer := make([]byte, f.bufferSize)
-	var result []string
+	defer watch(ctx, conn.SetDeadline)()
+	return f.protectDataConn(conn)
+}
 
-	for {
-		_, err := receiver.Read(buffer)
-		if err != nil && err == io.EOF {
-			break
-		} else if err != nil {
-			// error
-			errChan <- err
-			return
+// transferCommand sends a command that requires a data connection,
+// preceded by a REST if `offset` is not 0.
+// The server must answer with a 1xx reply, meaning that the data
+// connection is (going to be) opened.
+func (f *Conn) transferCommand(cmd string, offset int64) (*Response, error) {
+	if offset > 0 {
+		if err := f.restart(offset); err != nil {
+			return nil, err
 		}
-		read := string(buffer)
-		result = append(result, read)
 	}
+	response, err := f.writeCommandAndGetResponse(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if response.Code >= 200 {
+		return nil, newProtocolError(FileStatusOk, response)
+	}
+	return response, nil
+}
 
-	// final reading.
-	if _, err := f.getFtpResponse(); err != nil {
+// restart sends REST, so that the next transfer starts at `offset`.
+// Only the stream mode is supported, see https://tools.ietf.org/html/rfc3659#section-5
+func (f *Conn) restart(offset int64) error {
+	response, err := f.writeCommandAndGetResponse("REST " + strconv.FormatInt(offset, 10) + "\r\n")
+	if err != nil {
+		return err
+	}
+	if response.Code != RestOk {
+		return newProtocolError(RestOk, response)
+	}
+	return nil
+}
+
+// protectDataConn starts TLS on the data connection if PROT P is on.
+// According to RFC 4217 the FTP client is always the TLS client,
+// regardless of which side opened the connection, so this is true
+// for active mode as well.
+func (f *Conn) protectDataConn(conn net.Conn) (net.Conn, error) {
+	if f.protection != ProtectionPrivate {
+		f.lastDataTLSState = nil
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, f.dataTLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	f.lastDataTLSState = &state
+	return tlsConn, nil
+}
+
+func (f *Conn) internalLs(mode Mode, filepath string, doneChan chan<- []string, errChan chan<- error) {
+	var lines []string
+	err := f.locked(func() (err error) {
+		lines, err = f.list(context.Background(), mode, filepath)
+		return
+	})
+	if err != nil {
 		errChan <- err
 		return
 	}
+	doneChan <- lines
+}
 
-	doneChan <- result
+// list issues a LIST and returns the lines sent by the server.
+func (f *Conn) list(ctx context.Context, mode Mode, filepath string) ([]string, error) {
+	var cmd string
+
+	if filepath == "" {
+		cmd = "LIST\r\n"
+	} else {
+		cmd = "LIST " + filepath + "\r\n"
+	}
+
+	return f.dataLines(ctx, mode, cmd)
+}
+
+// dataLines issues `cmd` and returns the lines sent
+// by the server over the data connection.
+func (f *Conn) dataLines(ctx context.Context, mode Mode, cmd string) ([]string, error) {
+	f.ensureUTF8()
+
+	var buffer bytes.Buffer
+	t := &transfer{ctx: ctx}
+	if err := f.retrieveTo(mode, cmd, &buffer, t); err != nil {
+		if err == errAborted {
+			return nil, f.abortError(t)
+		}
+		return nil, err
+	}
+	return splitLines(buffer.String()), nil
+}
+
+// splitLines splits the content of a listing in lines,
+// skipping the empty ones.
+func splitLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (f *Conn) connectToAddr(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr.String())
+}
+
+// passiveAddr returns the address to connect to for a passive
+// data connection, using EPSV if extended, or PASV.
+func (f *Conn) passiveAddr(extended bool) (*net.TCPAddr, error) {
+	if extended && !f.noExtendedModes && f.supports("EPSV") {
+		addr, supported, err := f.epsvGetAddr()
+		if err != nil || supported {
+			return addr, err
+		}
+	}
+	if f.isIPv6() {
+		return nil, newFeatureNotSupportedError("EPSV")
+	}
+	if extended {
+		f.noExtendedModes = true
+	}
+	return f.pasvGetAddr()
 }
 
-func (f *Conn) connectToAddr(addr *net.TCPAddr) (net.Conn, error) {
-	return net.Dial("tcp4", addr.String())
+// epsvGetAddr issues the EPSV command and then it parses the response
+// returning a TCP Addr, whose IP is the one of the control connection.
+// supported is false if the server doesn't implement EPSV.
+func (f *Conn) epsvGetAddr() (addr *net.TCPAddr, supported bool, err error) {
+	if err = f.writeCommand("EPSV\r\n"); err != nil {
+		return nil, true, err
+	}
+	response, err := f.readResponse()
+	if err != nil {
+		return nil, true, err
+	}
+
+	if isExtendedModeRefused(response) {
+		return nil, false, nil
+	}
+	if response.Code != EpsvOk {
+		return nil, true, newProtocolError(EpsvOk, response)
+	}
+
+	port, err := parseEpsv(response)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return &net.TCPAddr{
+		IP:   f.control.RemoteAddr().(*net.TCPAddr).IP,
+		Port: port,
+	}, true, nil
 }
 
 // func (f *Conn) pasv() (*Response, error) {
@@ -530,7 +936,7 @@ func (f *Conn) pasvGetAddr() (*net.TCPAddr, error) {
 	}
 
 	if response.Code != PasvOk {
-		return nil, newUnexpectedCodeError(PasvOk, response.Code)
+		return nil, newProtocolError(PasvOk, response)
 	}
 
 	addr, err := parsePasv(response)
@@ -567,201 +973,22 @@ func (f *Conn) internalStore(
 	bufferSize int,
 ) {
 
-	/*
-				This command tells the server to abort the previous FTP
-		service command and any associated transfer of data.  The
-		abort command may require "special action", as discussed in
-		the Section on FTP Commands, to force recognition by the
-		server.  No action is to be taken if the previous command
-		has been completed (including data transfer).  The control
-		connection is not to be closed by the server, but the data
-		connection must be closed.
-
-		There are two cases for the server upon receipt of this
-		command: (1) the FTP service command was already completed,
-		or (2) the FTP service command is still in progress.
-
-			 In the first case, the server closes the data connection
-			 (if it is open) and responds with a 226 reply, indicating
-			 that the abort command was successfully processed.
-
-			 In the second case, the server aborts the FTP service in
-			 progress and closes the data connection, returning a 426
-			 reply to indicate that the service request terminated
-			 abnormally.  The server then sends a 226 reply,
-			 indicating that the abort command was successfully
-			 processed.
-	*/
-
-	var sender io.WriteCloser
-
-	if mode == IndMode {
-		mode = f.config.DefaultMode
-	}
-
-	usedBufferSize := f.bufferSize
-	if bufferSize > 0 && bufferSize <= MaxAllowedBufferSize {
-		usedBufferSize = bufferSize
-	}
-
-	if mode == ActiveMode {
-
-		listener, err := f.openListener()
-		if err != nil {
-			errChan <- err
-			return
-		}
-		defer listener.Close()
-
-		if _, err = f.writeCommandAndGetResponse("STOR " + dst + "\r\n"); err != nil {
-			errChan <- err
-			return
-		}
-
-		sender, err = listener.Accept()
-		if err != nil {
-			errChan <- err
-			return
-		}
-
-	} else if mode == PassiveMode {
-
-		addr, err := f.pasvGetAddr()
-		if err != nil {
-			errChan <- err
-			return
-		}
-
-		// write command
-		if _, err = f.writeCommandAndGetResponse("STOR " + dst + "\r\n"); err != nil {
-			errChan <- err
-			return
-		}
-
-		sender, err = f.connectToAddr(addr)
-		if err != nil {
-			errChan <- err
-			return
-		}
-
-	}
-
-	var n int
-	file, err := os.Open(src)
-	if err != nil {
-		errChan <- err
-		return
-	}
-
-	info, err := file.Stat()
-	if err != nil {
-		errChan <- err
-		return
-	}
-
-	buffer := make([]byte, usedBufferSize)
-
-	// command has been issued, notifying on startingChan
-	startingChan <- struct{}{}
-
-	for n < int(info.Size()) {
-
-		select {
-		case <-f.ctx.Done():
-			abortChan <- struct{}{}
-		// starting polling on abort
-		case <-abortChan:
-			// it's not completely correct to close here the data channel,
-			// but some server will expect the client to do this.
-			sender.Close()
-			response, err := f.writeCommandAndGetResponse("ABOR\r\n")
-			if err != nil {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				errChan <- err
-				return
-			}
-
-			// SOME SERVER LIKE APACHE WILL RETURN US A 226
-			// EVEN IF NO FILE HAS BEEN TRANSFERED, WHILE,
-			// ACCORDING TO RFC IT'D RETURN US A 426 FOLLOWED BY A 226.
-			// SO IT RETURNS US 226 AND 226.
-
-			// this in theory should be only if == AbortOk
-			if response.Code == AbortOk || response.Code == TransferOk {
-				// after the first response, server must send another with
-				// 226.
-				abortResponse, err := f.getFtpResponse()
-				if err != nil {
-					// very bad
-					if onEachChan != nil {
-						close(onEachChan)
-					}
-					errChan <- err
-					return
-				} else if abortResponse.Code != TransferOk {
-					if onEachChan != nil {
-						close(onEachChan)
-					}
-					errChan <- newUnexpectedCodeError(TransferOk, abortResponse.Code)
-					return
-				}
-			} else {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				errChan <- newUnexpectedCodeError(AbortOk, response.Code)
-				return
-			}
-
-			// deleting the file if required.
-			if deleteIfAbort {
-				if _, err := f.DeleteFile(dst); err != nil {
-					errChan <- err
-				}
-			}
-			if onEachChan != nil {
-				close(onEachChan)
-			}
-			doneChan <- struct{}{}
-			return
-
-		// when no abort has been received, go on
-		default:
-			// reading from file
-			read, err := file.Read(buffer)
-			if err != nil {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				sender.Close()
-				errChan <- err
-				return
-			}
-
-			// updating the number of read bytes
-			n += read
-			_, err = sender.Write(buffer[:read])
-			if err != nil {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				sender.Close()
-				errChan <- err
-				return
-			}
-			if onEachChan != nil {
-				onEachChan <- read
-			}
-		}
-	}
-
-	// until I close the data connection it doesn't answer me.
-	sender.Close()
+	f.acquire(context.Background())
+	defer f.release()
+	err := f.storeFile(mode, src, dst, &transfer{
+		abort:         abortChan,
+		deleteIfAbort: deleteIfAbort,
+		onStart: func() error {
+			// command has been issued, notifying on startingChan
+			startingChan <- struct{}{}
+			return nil
+		},
+		onEach:     onEachFunc(onEachChan),
+		bufferSize: bufferSize,
+	})
 
-	// when completed reading response.
-	if _, err := f.getFtpResponse(); err != nil {
+	// an abort is not an error here.
+	if err != nil && err != errAborted {
 		if onEachChan != nil {
 			close(onEachChan)
 		}
@@ -775,6 +1002,7 @@ func (f *Conn) internalStore(
 	}
 }
 
+// TODO see args order.
 // Retrieve download a file located at filepathSrc to filepathDest.
 // When finished, it writes into doneChan. Any error, that'll make it immediately exits,
 // is written into errChan.
@@ -789,196 +1017,220 @@ func (f *Conn) internalRetr(mode Mode,
 	bufferSize int,
 ) {
 
-	var receiver io.ReadCloser
+	f.acquire(context.Background())
+	defer f.release()
+	err := f.retrieveFile(mode, filepathSrc, filepathDest, &transfer{
+		abort: abortChan,
+		onStart: func() error {
+			// command has been issued, notify on startingChan
+			startingChan <- struct{}{}
+			return nil
+		},
+		onEach:     onEachFunc(onEachChan),
+		bufferSize: bufferSize,
+	})
 
-	if mode == IndMode {
-		mode = f.config.DefaultMode
+	// an abort is not an error here.
+	if err != nil && err != errAborted {
+		if onEachChan != nil {
+			close(onEachChan)
+		}
+		errChan <- err
+		return
 	}
 
-	usedBufferSize := f.bufferSize
-	if bufferSize > 0 && bufferSize <= MaxAllowedBufferSize {
-		usedBufferSize = bufferSize
+	doneChan <- struct{}{}
+	if onEachChan != nil {
+		close(onEachChan)
 	}
+}
 
-	if mode == ActiveMode {
+// storeFile uploads the local file `src` to `dst`.
+// If the transfer is aborted, errAborted is returned after
+// deleting `dst` if required.
+func (f *Conn) storeFile(mode Mode, src, dst string, t *transfer) error {
+	if t.resume && f.transferType(t) == TypeASCII {
+		return errResumeASCII
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		//opening a listener.
-		listener, err := f.openListener()
+	cmd := "STOR "
+	if t.appendOnly {
+		cmd = "APPE "
+	}
+
+	if t.resume {
+		offset, err := f.resumeOffset(file, dst)
 		if err != nil {
-			errChan <- err
-			return
+			return err
 		}
-		defer listener.Close()
-
-		// sending command.
-		if _, err = f.writeCommandAndGetResponse("RETR " + filepathSrc + "\r\n"); err != nil {
-			errChan <- err
-			return
+		if offset < 0 {
+			// already complete.
+			return nil
 		}
-
-		// accept connection.
-		receiver, err = listener.Accept()
-		if err != nil {
-			errChan <- err
-			return
+		if offset > 0 {
+			cmd = "APPE "
 		}
-	} else if mode == PassiveMode {
+	}
 
-		addr, err := f.pasvGetAddr()
-		if err != nil {
-			errChan <- err
-			return
+	err = f.storeFrom(mode, cmd+dst+"\r\n", file, t)
+	if err == nil && t.checksum != nil {
+		var start int64
+		if cmd == "APPE " {
+			// what has been sent is at the end of the file.
+			_, size, err := f.size(dst)
+			if err != nil {
+				return err
+			}
+			start = int64(size) - t.transferred
 		}
-
-		// write command
-		if _, err = f.writeCommandAndGetResponse("RETR " + filepathSrc + "\r\n"); err != nil {
-			errChan <- err
-			return
+		// a resumed file is equal to the local one, unlike an appended one.
+		var whole string
+		if !t.appendOnly {
+			whole = src
 		}
-
-		receiver, err = f.connectToAddr(addr)
+		if err = f.verifyChecksum(dst, t, start, whole); err != nil {
+			return err
+		}
+	}
+	if err == nil && t.preserveTimes {
+		info, err := file.Stat()
 		if err != nil {
-			errChan <- err
-			return
+			return err
+		}
+		_, err = f.setModificationTime(dst, info.ModTime())
+		return err
+	}
+	if err == errAborted && t.deleteIfAbort {
+		// deleting the file if required.
+		if _, deleteErr := f.deleteFile(dst); deleteErr != nil {
+			return deleteErr
 		}
 	}
+	return err
+}
 
-	file, err := os.Create(filepathDest)
+// resumeOffset compares the size of the remote file `dst` with the
+// local file, and seeks the local one to where the upload has to continue.
+// It returns -1 if the remote file is already complete, and 0 if the
+// upload has to restart from the beginning.
+func (f *Conn) resumeOffset(file *os.File, dst string) (int64, error) {
+	info, err := file.Stat()
 	if err != nil {
-		errChan <- err
-		return
+		return 0, err
+	}
+	// any error here (e.g. the file doesn't exist yet)
+	// means that we have to start from the beginning.
+	_, remoteSize, err := f.size(dst)
+	if err != nil || remoteSize == 0 {
+		return 0, nil
 	}
 
-	// starting reading into receiver
-	buffer := make([]byte, usedBufferSize)
-
-	loop := true
-
-	// command has been issued, notify on startingChan
-	startingChan <- struct{}{}
-
-	// filee, _ := os.Create("fuckkk")
-
-	for loop {
-
-		select {
-		case <-f.ctx.Done():
-			abortChan <- struct{}{}
-		case <-abortChan:
-			// log.Printf("received abort")
-			receiver.Close()
-			// var response *Response //declaring here just to prevent go vet.
-			response, err := f.writeCommandAndGetResponse("ABOR\r\n")
-			if err != nil {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				errChan <- err
-
-				os.Remove(file.Name()) //skipping the error.
-				return
-			}
+	offset := int64(remoteSize)
+	switch {
+	case offset == info.Size():
+		return -1, nil
+	case offset > info.Size():
+		// not a partial copy of this file.
+		return 0, nil
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
 
-			// if 426 we have to wait for another response.
-			// if 226 the transfer is complete
-			if response.Code == AbortOk || response.Code == TransferOk {
-				// ok, wait for another.
-				abortResponse, err := f.getFtpResponse()
-				if err != nil {
-					if onEachChan != nil {
-						close(onEachChan)
-					}
-					// very bad
-					errChan <- err
-					return
-				} else if abortResponse.Code != TransferOk {
-					if onEachChan != nil {
-						close(onEachChan)
-					}
-					errChan <- newUnexpectedCodeError(TransferOk, abortResponse.Code)
-					return
-				}
-			} else {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				errChan <- newUnexpectedCodeError(AbortOk, response.Code)
-				return
-			}
+// retrieveFile downloads `src` into the local file `dst`.
+// The local file is created only once the server has accepted
+// the RETR, and it's removed if the transfer is aborted, unless
+// the transfer is resumable.
+func (f *Conn) retrieveFile(mode Mode, src, dst string, t *transfer) error {
+	if t.resume && f.transferType(t) == TypeASCII {
+		return errResumeASCII
+	}
+	withFile := *t
 
-			err = os.Remove(file.Name())
-			if err != nil {
-				errChan <- err
-			} else {
-				// if onEachChan != nil {
-				// 	close(onEachChan)
-				// }
-				doneChan <- struct{}{}
-			}
-			if onEachChan != nil {
-				close(onEachChan)
-			}
-			return
-
-		default:
-			var n int
-			n, err = receiver.Read(buffer)
-
-			if err != nil && err == io.EOF {
-				// I know that it is ugly
-				// but in this way we can skip some if.
-				// EOF means the connection has been closed.
-				loop = false
-				continue // before there was a break but it'll make
-				// exiting just from the select.
-			} else if err != nil {
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				receiver.Close()
-				errChan <- err
-				return
+	if t.resume {
+		if info, err := os.Stat(dst); err == nil {
+			withFile.offset = info.Size()
+		}
+	}
+	if withFile.offset > 0 {
+		if !f.supportsRestStream() {
+			return newFeatureNotSupportedError("REST STREAM")
+		}
+		// if SIZE is not available we rely on the server
+		// refusing a REST beyond the end of the file.
+		if _, remoteSize, err := f.size(src); err == nil {
+			switch {
+			case int64(remoteSize) == withFile.offset:
+				// already complete.
+				return nil
+			case int64(remoteSize) < withFile.offset:
+				// not a partial copy of this file.
+				withFile.offset = 0
 			}
+		}
+	}
 
-			// so we can skip null bytes that are added
-			/// to fill the buffer size.
-
-			// index := bytes.IndexByte(buffer, 0)
-			// if index == -1 {
-			// 	index = len(buffer)
-			// }
-			if onEachChan != nil {
-				// onEachChan <- struct{}{}
+	var file *os.File
+	writer := writerFunc(func(p []byte) (int, error) {
+		return file.Write(p)
+	})
+
+	withFile.onStart = func() error {
+		var err error
+		if withFile.offset > 0 {
+			file, err = os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0)
+		} else {
+			file, err = os.Create(dst)
+		}
+		if err != nil {
+			return err
+		}
+		if t.onStart != nil {
+			return t.onStart()
+		}
+		return nil
+	}
 
-				// onEachChan <- index
-				onEachChan <- n
-			}
+	err := f.retrieveTo(mode, "RETR "+src+"\r\n", writer, &withFile)
+	t.started, t.transferred = withFile.started, withFile.transferred
+	if file == nil {
+		return err
+	}
+	file.Close()
 
-			if _, err = file.Write(buffer[:n]); err != nil {
-				// closing the connection as well
-				if onEachChan != nil {
-					close(onEachChan)
-				}
-				receiver.Close()
-				errChan <- err
-				return
-			}
+	if err == nil && withFile.checksum != nil {
+		if err = f.verifyChecksum(src, &withFile, withFile.offset, dst); err != nil {
+			return err
 		}
 	}
-
-	// now getting the response.
-	// it's not unreachable code...
-	_, err = f.getFtpResponse()
-	if err != nil {
-		if onEachChan != nil {
-			close(onEachChan)
+	if err == nil && t.preserveTimes {
+		_, modTime, err := f.lastModificationTime(src)
+		if err != nil {
+			return err
 		}
-		errChan <- err
-		return
+		return os.Chtimes(dst, *modTime, *modTime)
 	}
+	if err == errAborted && !t.resume {
+		// skipping the error.
+		os.Remove(dst)
+	}
+	return err
+}
 
-	doneChan <- struct{}{}
-	if onEachChan != nil {
-		close(onEachChan)
+// onEachFunc returns a function that writes on onEachChan,
+// or nil if the channel is nil.
+func onEachFunc(onEachChan chan<- int) func(int) {
+	if onEachChan == nil {
+		return nil
+	}
+	return func(n int) {
+		onEachChan <- n
 	}
 }
@@ -17,12 +17,29 @@ limitations under the License.
 package ftp
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -73,7 +90,7 @@ func TestDialAndAuthenticate(t *testing.T) {
 
 	defer ftpConn.Quit()
 
-	t.Logf(resp.String())
+	t.Log(resp.String())
 
 }
 
@@ -122,6 +139,225 @@ func TestParsePasvOk(t *testing.T) {
 	}
 }
 
+// replyConn returns a Conn whose control channel
+// reads from the given string.
+func replyConn(replies string) *Conn {
+	return &Conn{
+		config: &Config{},
+		controlRw: bufio.NewReadWriter(
+			bufio.NewReader(strings.NewReader(replies)),
+			bufio.NewWriter(ioutil.Discard),
+		),
+	}
+}
+
+func TestReadResponseMultiLine(t *testing.T) {
+
+	ftpConn := replyConn("220-Welcome to the server\r\n" +
+		"220-Second line\r\n" +
+		"  220 not the end\r\n" +
+		"220 Ready\r\n" +
+		"331 Please specify the password.\r\n")
+
+	response, err := ftpConn.readResponse()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if response.Code != FirstConnOk {
+		t.Errorf("Want code %d, got %d", FirstConnOk, response.Code)
+	}
+	if response.Msg != "Welcome to the server" {
+		t.Errorf("Unexpected msg: '%s'", response.Msg)
+	}
+	want := []string{"Welcome to the server", "Second line", "  220 not the end", "Ready"}
+	if !reflect.DeepEqual(want, response.Lines) {
+		t.Errorf("Unexpected lines: %v", response.Lines)
+	}
+
+	// the next reply must not be stale.
+	response, err = ftpConn.readResponse()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if response.Code != UsernameOk {
+		t.Errorf("Want code %d, got %d", UsernameOk, response.Code)
+	}
+}
+
+func TestReadResponseGarbage(t *testing.T) {
+
+	for _, reply := range []string{"\r\n", "22\r\n", "abc hello\r\n"} {
+		if _, err := replyConn(reply).readResponse(); err == nil {
+			t.Errorf("Expected an error for %q", reply)
+		}
+	}
+
+	response, err := replyConn("200\r\n").readResponse()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if response.Code != NoopOk || response.Msg != "" {
+		t.Errorf("Unexpected response: %s", response.String())
+	}
+}
+
+func TestParseFeatures(t *testing.T) {
+
+	ftpConn := replyConn("211-Features:\r\n" +
+		" MDTM\r\n" +
+		" REST STREAM\r\n" +
+		" SIZE\r\n" +
+		" MLST type*;size*;modify*;perm;\r\n" +
+		" UTF8\r\n" +
+		" AUTH TLS\r\n" +
+		" AUTH SSL\r\n" +
+		" HASH SHA-1;SHA-256*;MD5\r\n" +
+		"211 End\r\n")
+
+	features, err := ftpConn.Features()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !features.Available() {
+		t.Fatalf("Features should be available")
+	}
+	if !features.MDTM || !features.Size || !features.RestStream || !features.UTF8 {
+		t.Errorf("Missing features: %+v", features)
+	}
+	if !features.AuthTLS || !features.AuthSSL {
+		t.Errorf("Missing AUTH params: %+v", features)
+	}
+	if features.EPSV || features.Has("MFMT") {
+		t.Errorf("Unexpected features: %+v", features)
+	}
+	if !reflect.DeepEqual(features.MLSTFacts, []string{"type", "size", "modify", "perm"}) {
+		t.Errorf("Unexpected MLST facts: %v", features.MLSTFacts)
+	}
+	if features.HashSelected != "SHA-256" || len(features.HashAlgorithms) != 3 {
+		t.Errorf("Unexpected HASH: %v, %s", features.HashAlgorithms, features.HashSelected)
+	}
+
+	// the second call must use the cache.
+	if cached, err := ftpConn.Features(); err != nil || cached != features {
+		t.Errorf("Features not cached")
+	}
+
+	if ftpConn.supports("MFMT") {
+		t.Errorf("MFMT should not be supported")
+	}
+}
+
+func TestFeatNotImplemented(t *testing.T) {
+
+	ftpConn := replyConn("502 Command not implemented.\r\n")
+	features, err := ftpConn.Features()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if features.Available() {
+		t.Errorf("Features should not be available")
+	}
+	// when we don't know, we always try.
+	if !ftpConn.supports("SIZE") {
+		t.Errorf("SIZE should be tried")
+	}
+}
+
+func TestParseEpsvOk(t *testing.T) {
+
+	response, err := newFtpResponse("229 Entering Extended Passive Mode (|||6446|)")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	port, err := parseEpsv(response)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if port != 6446 {
+		t.Fatalf("Port is not correct: %d", port)
+	}
+
+	response, _ = newFtpResponse("229 Entering Extended Passive Mode (!!!6446)")
+	if _, err = parseEpsv(response); err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
+
+func TestPortStrings(t *testing.T) {
+
+	if got := portString(net.IPv4(127, 0, 0, 1), 179, 36); got != "127,0,0,1,179,36" {
+		t.Errorf("Unexpected PORT string: %s", got)
+	}
+	if got := eprtString(net.IPv4(132, 235, 1, 2), 6275); got != "|1|132.235.1.2|6275|" {
+		t.Errorf("Unexpected EPRT string: %s", got)
+	}
+	if got := eprtString(net.ParseIP("1080::8:800:200C:417A"), 5282); got != "|2|1080::8:800:200c:417a|5282|" {
+		t.Errorf("Unexpected EPRT string: %s", got)
+	}
+}
+
+func TestLocalDialIP(t *testing.T) {
+	v4, v6 := net.IPv4(127, 0, 0, 1), net.ParseIP("::1")
+
+	if got := localDialIP(v4, "127.0.0.1:21"); !got.Equal(v4) {
+		t.Errorf("Unexpected IP: %s", got)
+	}
+	if got := localDialIP(v4, "[::1]:21"); got != nil {
+		t.Errorf("Unexpected IP: %s", got)
+	}
+	if got := localDialIP(v6, "127.0.0.1:21"); got != nil {
+		t.Errorf("Unexpected IP: %s", got)
+	}
+	if got := localDialIP(v6, "localhost:21"); !got.Equal(v6) {
+		t.Errorf("Unexpected IP: %s", got)
+	}
+}
+
+func TestExtendedModeRefused(t *testing.T) {
+	listener, err := newStubServer("220 Welcome", map[string]string{
+		"FEAT": "502 Not implemented",
+		"EPSV": "522 Network protocol not supported, use (1)",
+		"EPRT": "522 Network protocol not supported, use (1)",
+		"PASV": "227 Entering Passive Mode (127,0,0,1,4,1)",
+		"PORT": "200 PORT ok",
+		"QUIT": "221 Goodbye",
+	})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+
+	ftpConn, _, err := Dial(listener.Addr().String(), &Config{
+		DefaultMode: ExtendedPassiveMode,
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Dial error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	addr, err := ftpConn.passiveAddr(true)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if addr.Port != 1025 {
+		t.Errorf("Unexpected port: %d", addr.Port)
+	}
+	if !ftpConn.noExtendedModes {
+		t.Errorf("Extended modes should be off")
+	}
+
+	ftpConn.noExtendedModes = false
+	dataListener, err := ftpConn.openListener(true)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	dataListener.Close()
+	if !ftpConn.noExtendedModes {
+		t.Errorf("Extended modes should be off")
+	}
+}
+
 func internalFilesOps(t *testing.T, mode Mode, useSimple bool, bufferSize int) {
 	ftpConn, _, err := authenticatedConn()
 
@@ -136,7 +372,7 @@ func internalFilesOps(t *testing.T, mode Mode, useSimple bool, bufferSize int) {
 	defer os.Remove("tmp.txt")
 
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 	_, err = file.Write(fileContent)
@@ -287,6 +523,14 @@ func TestFileOpsPassiveAsyncCustomBuffer(t *testing.T) {
 	internalFilesOps(t, PassiveMode, false, MaxAllowedBufferSize)
 }
 
+func TestFileOpsExtendedActiveSync(t *testing.T) {
+	internalFilesOps(t, ExtendedActiveMode, true, 0)
+}
+
+func TestFileOpsExtendedPassiveSync(t *testing.T) {
+	internalFilesOps(t, ExtendedPassiveMode, true, 0)
+}
+
 func internalDirOps(t *testing.T, mode Mode, useSimple bool) {
 	ftpConn, _, err := authenticatedConn()
 
@@ -364,7 +608,7 @@ func internalDirOps(t *testing.T, mode Mode, useSimple bool) {
 			// building a response from this error.
 			response, err := newFtpResponse(err.Error())
 			if err != nil {
-				t.Errorf(err.Error())
+				t.Error(err.Error())
 				return
 			}
 			if response.Code != FileUnavailable {
@@ -390,7 +634,7 @@ func internalDirOps(t *testing.T, mode Mode, useSimple bool) {
 		if err != nil {
 			response, err := newFtpResponse(err.Error())
 			if err != nil {
-				t.Errorf(err.Error())
+				t.Error(err.Error())
 				return
 			}
 			if response.Code != FileUnavailable {
@@ -441,12 +685,12 @@ func TestRename(t *testing.T) {
 	defer os.Remove("tmp.txt")
 
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 	_, err = file.Write(fileContent)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -518,12 +762,12 @@ func internalStoreAbort(t *testing.T, beforeOrAfter bool) {
 	defer os.Remove("tmp.txt")
 
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 	_, err = file.Write(fileContent)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -594,7 +838,7 @@ func internalRetrAbort(t *testing.T, beforeOrAfter bool) {
 	fileContent := []byte("hello this is an example")
 	file, err := os.Create("tmp.txt")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -602,7 +846,7 @@ func internalRetrAbort(t *testing.T, beforeOrAfter bool) {
 
 	_, err = file.Write(fileContent)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -667,7 +911,7 @@ func TestParseTimeNoop(t *testing.T) {
 
 	response, err := newFtpResponse("213 20180226133244.000")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 	}
 
 	date, err := response.getTime()
@@ -677,7 +921,7 @@ func TestParseTimeNoop(t *testing.T) {
 
 	ftpConn, _, err := authenticatedConn()
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
 	}
 
 	defer ftpConn.Quit()
@@ -685,7 +929,7 @@ func TestParseTimeNoop(t *testing.T) {
 	fileContent := []byte("hello this is an example")
 	file, err := os.Create("tmp.txt")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -693,7 +937,7 @@ func TestParseTimeNoop(t *testing.T) {
 
 	_, err = file.Write(fileContent)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -722,14 +966,14 @@ func TestParseTimeNoop(t *testing.T) {
 
 	gotResponse, gotDate, err := ftpConn.LastModificationTime("tmp.txt")
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
 	//finally a noop
 	noopResponse, err := ftpConn.Noop()
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err.Error())
 		return
 	}
 
@@ -762,7 +1006,7 @@ func TestAuthTLS(t *testing.T) {
 			strings.Contains(err.Error(), "bind: address already in use") {
 			t.Logf("Got \"expected\" error from handshake: %s", err.Error())
 		} else {
-			t.Errorf(err.Error())
+			t.Error(err.Error())
 		}
 	} else {
 		ftpConn.Quit()
@@ -776,11 +1020,2072 @@ func TestAuthTLS(t *testing.T) {
 	// }
 }
 
-func TestBufferSize(t *testing.T) {
+func internalProtectedFilesOps(t *testing.T, mode Mode) {
+	ftpConn, _, err := DialAndAuthenticate("localhost:2121",
+		&Config{
+			Username: "anonymous",
+			Password: "c@b.com",
+			TLSOption: &TLSOption{
+				AuthTLSOnFirst: true,
+				SkipVerify:     true,
+				ProtectData:    true,
+			},
+			DefaultMode: mode,
+			LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+		},
+	)
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+
+	defer ftpConn.Quit()
+
+	if ftpConn.DataProtection() != ProtectionPrivate {
+		t.Fatalf("Want protection %s, got %s", ProtectionPrivate, ftpConn.DataProtection())
+	}
+	if _, err = ftpConn.AuthTLS(false, false); err != ErrAlreadyTLS {
+		t.Errorf("Expected ErrAlreadyTLS, got: %v", err)
+	}
+
+	fileContent := []byte("hello this is an example")
+	if err = ioutil.WriteFile("tmp.txt", fileContent, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove("tmp.txt")
+
+	if err = ftpConn.StoreSimple(mode, "tmp.txt", "tmp.txt"); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+		return
+	}
+	defer ftpConn.DeleteFile("tmp.txt")
+
+	if err = ftpConn.RetrSimple(mode, "tmp.txt", "temp_get.txt"); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+		return
+	}
+	defer os.Remove("temp_get.txt")
+
+	state := ftpConn.LastDataConnectionState()
+	if state == nil {
+		t.Errorf("Data connection is not TLS-ed")
+		return
+	}
+	t.Logf("Data connection resumed TLS session: %t", state.DidResume)
+
+	content, err := ioutil.ReadFile("temp_get.txt")
+	if err != nil {
+		t.Errorf("Got error: %s", err.Error())
+		return
+	}
+	if !reflect.DeepEqual(fileContent, content) {
+		t.Errorf("Mismatched files")
+	}
+}
+
+func TestProtectedFileOpsActive(t *testing.T) {
+	internalProtectedFilesOps(t, ActiveMode)
+}
+
+func TestProtectedFileOpsPassive(t *testing.T) {
+	internalProtectedFilesOps(t, PassiveMode)
+}
+
+func internalStreamOps(t *testing.T, mode Mode) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	fileContent := []byte("hello this is a streamed example")
+
+	if err = ftpConn.StoreFrom(context.Background(), mode, "stream.txt",
+		bytes.NewReader(fileContent)); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("stream.txt")
+
+	var buffer bytes.Buffer
+	if err = ftpConn.RetrieveTo(context.Background(), mode, "stream.txt", &buffer); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !bytes.Equal(buffer.Bytes(), fileContent) {
+		t.Errorf("Content mismatch, got: %q", buffer.String())
+	}
+
+	writer, err := ftpConn.OpenWrite("stream.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = writer.Write(fileContent[:5]); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	reader, err := ftpConn.OpenRead("stream.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	read, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = reader.Close(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !bytes.Equal(read, fileContent[:5]) {
+		t.Errorf("Content mismatch, got: %q", read)
+	}
+
+	// the connection must still be usable after
+	// a reader closed before EOF.
+	if reader, err = ftpConn.OpenRead("stream.txt"); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = reader.Close(); err != nil {
+		t.Errorf("Fail to abort: %s", err.Error())
+	}
+	if _, err = ftpConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+
+	// and after a local error in the middle of a transfer.
+	localErr := errors.New("local error")
+	failing := io.MultiReader(bytes.NewReader(fileContent), iotest.ErrReader(localErr))
+	if err = ftpConn.StoreFrom(context.Background(), mode, "failed.txt", failing); err != localErr {
+		t.Errorf("Expected the local error, got: %v", err)
+	}
+	ftpConn.DeleteFile("failed.txt")
+	if _, err = ftpConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	failingWriter := writerFunc(func(p []byte) (int, error) {
+		return 0, localErr
+	})
+	if err = ftpConn.RetrieveTo(context.Background(), mode, "stream.txt", failingWriter); err != localErr {
+		t.Errorf("Expected the local error, got: %v", err)
+	}
+	if _, err = ftpConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+func TestStreamOpsActive(t *testing.T) {
+	internalStreamOps(t, ActiveMode)
+}
+
+func TestStreamOpsPassive(t *testing.T) {
+	internalStreamOps(t, PassiveMode)
+}
+
+func TestRetrieveToCanceled(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	if err = ftpConn.StoreFrom(context.Background(), PassiveMode, "canceled.txt",
+		strings.NewReader("some content")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("canceled.txt")
 
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = ftpConn.RetrieveTo(ctx, PassiveMode, "canceled.txt", ioutil.Discard)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if _, err = ftpConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+// countingProgress counts the bytes of a transfer.
+type countingProgress struct {
+	started bool
+	total   int
+}
+
+func (p *countingProgress) Started() {
+	p.started = true
+}
+
+func (p *countingProgress) Transferred(n int) {
+	p.total += n
+}
+
+func internalContextOps(t *testing.T, mode Mode) {
 	ftpConn, _, err := authenticatedConn()
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	fileContent := []byte("hello this is a context example")
+	if err = ioutil.WriteFile("ctx.txt", fileContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("ctx.txt")
+	defer os.Remove("ctx_get.txt")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	progress := &countingProgress{}
+	if err = ftpConn.StoreContext(ctx, mode, "ctx.txt", "ctx.txt",
+		&TransferOptions{Progress: progress}); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("ctx.txt")
+	if !progress.started || progress.total != len(fileContent) {
+		t.Errorf("Wrong progress: %+v", progress)
+	}
+
+	if err = ftpConn.RetrieveContext(ctx, mode, "ctx.txt", "ctx_get.txt", nil); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	read, err := ioutil.ReadFile("ctx_get.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, fileContent) {
+		t.Errorf("Content mismatch, got: %q", read)
+	}
+
+	lines, err := ftpConn.ListContext(ctx, mode, "")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	found := false
+	for _, line := range lines {
+		if strings.Contains(line, "\n") {
+			t.Errorf("Line not splitted: %q", line)
+		}
+		if strings.HasSuffix(line, "ctx.txt") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ctx.txt not found in: %v", lines)
+	}
+}
+
+func TestContextOpsActive(t *testing.T) {
+	internalContextOps(t, ActiveMode)
+}
+
+func TestContextOpsPassive(t *testing.T) {
+	internalContextOps(t, PassiveMode)
+}
+
+func TestContextCanceled(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = ftpConn.CdContext(ctx, "/"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if _, err = ftpConn.ListContext(ctx, PassiveMode, ""); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if err = ftpConn.RetrieveContext(ctx, PassiveMode, "ctx.txt", "ctx_get.txt", nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if _, err = os.Stat("ctx_get.txt"); !os.IsNotExist(err) {
+		os.Remove("ctx_get.txt")
+		t.Errorf("Local file should not exist")
+	}
+
+	// nothing has been sent, the connection is still usable.
+	if _, err = ftpConn.NoopContext(context.Background()); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+func TestContextCanceledDuringTransfer(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	content := bytes.Repeat([]byte("0123456789"), 1<<20)
+	if err = ftpConn.StoreFrom(context.Background(), PassiveMode, "big.txt",
+		bytes.NewReader(content)); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("big.txt")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// canceling as soon as something has been received.
+	writer := writerFunc(func(p []byte) (int, error) {
+		cancel()
+		return len(p), nil
+	})
+
+	if err = ftpConn.RetrieveTo(ctx, PassiveMode, "big.txt", writer); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if _, err = ftpConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+func internalResumeOps(t *testing.T, mode Mode) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	fileContent := bytes.Repeat([]byte("resume me "), 1000)
+	half := len(fileContent) / 2
+	ctx := context.Background()
+	opts := &TransferOptions{Resume: true}
+
+	// resuming the upload.
+	if err = ioutil.WriteFile("resume.txt", fileContent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("resume.txt")
+
+	if err = ftpConn.StoreFrom(ctx, mode, "resume.txt", bytes.NewReader(fileContent[:half])); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("resume.txt")
+
+	progress := &countingProgress{}
+	opts.Progress = progress
+	if err = ftpConn.StoreContext(ctx, mode, "resume.txt", "resume.txt", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if progress.total != len(fileContent)-half {
+		t.Errorf("Expected %d bytes to be sent, got %d", len(fileContent)-half, progress.total)
+	}
+
+	var buffer bytes.Buffer
+	if err = ftpConn.RetrieveTo(ctx, mode, "resume.txt", &buffer); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !bytes.Equal(buffer.Bytes(), fileContent) {
+		t.Fatalf("Upload not resumed correctly, got %d bytes", buffer.Len())
+	}
+
+	// resuming the download.
+	if err = ioutil.WriteFile("resume_get.txt", fileContent[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("resume_get.txt")
+
+	progress = &countingProgress{}
+	opts.Progress = progress
+	if err = ftpConn.RetrieveContext(ctx, mode, "resume.txt", "resume_get.txt", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if progress.total != len(fileContent)-half {
+		t.Errorf("Expected %d bytes to be received, got %d", len(fileContent)-half, progress.total)
+	}
+	read, err := ioutil.ReadFile("resume_get.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, fileContent) {
+		t.Fatalf("Download not resumed correctly, got %d bytes", len(read))
+	}
+
+	// nothing to do when already complete.
+	progress = &countingProgress{}
+	opts.Progress = progress
+	if err = ftpConn.RetrieveContext(ctx, mode, "resume.txt", "resume_get.txt", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if progress.started {
+		t.Errorf("Complete file should not be transferred again")
+	}
+}
+
+func TestResumeOpsActive(t *testing.T) {
+	internalResumeOps(t, ActiveMode)
+}
+
+func TestResumeOpsPassive(t *testing.T) {
+	internalResumeOps(t, PassiveMode)
+}
+
+func TestAppend(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	ctx := context.Background()
+	for _, part := range []string{"first ", "second"} {
+		if err = ftpConn.AppendFrom(ctx, PassiveMode, "append.txt", strings.NewReader(part)); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+	}
+	defer ftpConn.DeleteFile("append.txt")
+
+	var buffer bytes.Buffer
+	if err = ftpConn.RetrieveTo(ctx, PassiveMode, "append.txt", &buffer); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if buffer.String() != "first second" {
+		t.Errorf("Wrong content: %q", buffer.String())
+	}
+}
+
+func TestMLSx(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	if _, err = ftpConn.MkDir("mlsx"); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteDir("mlsx")
+	if err = ftpConn.StoreFrom(context.Background(), PassiveMode, "mlsx/file.txt",
+		strings.NewReader("content")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("mlsx/file.txt")
+
+	entries, err := ftpConn.MLSD("mlsx")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.Name == "file.txt" {
+			found = true
+			if entry.Type != EntryFile || entry.Size != 7 || entry.ModTime.IsZero() {
+				t.Errorf("Wrong entry: %+v", entry)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("file.txt not found in: %+v", entries)
+	}
+
+	entry, err := ftpConn.MLST("mlsx")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !entry.Type.IsDir() {
+		t.Errorf("Wrong entry: %+v", entry)
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	if err = ftpConn.StoreFrom(context.Background(), PassiveMode, "entries.txt",
+		strings.NewReader("content")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("entries.txt")
+
+	entries, err := ftpConn.ListEntries(context.Background(), PassiveMode, "")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	for _, entry := range entries {
+		if entry.Name == "entries.txt" {
+			if entry.Type != EntryFile || entry.Size != 7 {
+				t.Errorf("Wrong entry: %+v", entry)
+			}
+			return
+		}
+	}
+	t.Errorf("entries.txt not found in: %+v", entries)
+}
+
+func internalWalk(t *testing.T, useMLSD bool) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	if !useMLSD {
+		// forcing the LIST parsing.
+		ftpConn.features = &Features{features: make(map[string]string), available: true}
+	}
+
+	ctx := context.Background()
+	dirs := []string{"walk", "walk/sub", "walk/sub/deep", "walk/with space"}
+	files := []string{"walk/a.txt", "walk/sub/b.txt", "walk/sub/deep/c.txt", "walk/with space/d e.txt"}
+	for _, dir := range dirs {
+		if _, err = ftpConn.MkDir(dir); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+	}
+	for _, file := range files {
+		if err = ftpConn.StoreFrom(ctx, PassiveMode, file, strings.NewReader(file)); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+	}
+	defer func() {
+		for i := len(files) - 1; i >= 0; i-- {
+			ftpConn.DeleteFile(files[i])
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			ftpConn.DeleteDir(dirs[i])
+		}
+	}()
+
+	walk := func(opts *WalkOptions, skip string) []string {
+		var walked []string
+		err := ftpConn.Walk("walk", func(remotePath string, entry *Entry, err error) error {
+			if err != nil {
+				return err
+			}
+			walked = append(walked, remotePath)
+			if remotePath == skip {
+				return SkipDir
+			}
+			return nil
+		}, opts)
+		if err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+		return walked
+	}
+
+	expected := "walk,walk/a.txt,walk/sub,walk/sub/b.txt,walk/sub/deep,walk/sub/deep/c.txt,walk/with space,walk/with space/d e.txt"
+	if walked := strings.Join(walk(nil, ""), ","); walked != expected {
+		t.Errorf("Wrong walk, expected %s, got %s", expected, walked)
+	}
+
+	expected = "walk,walk/a.txt,walk/sub,walk/with space"
+	if walked := strings.Join(walk(&WalkOptions{MaxDepth: 1}, ""), ","); walked != expected {
+		t.Errorf("Wrong walk, expected %s, got %s", expected, walked)
+	}
+
+	expected = "walk,walk/a.txt,walk/sub,walk/with space,walk/with space/d e.txt"
+	if walked := strings.Join(walk(nil, "walk/sub"), ","); walked != expected {
+		t.Errorf("Wrong walk, expected %s, got %s", expected, walked)
+	}
+
+	names, err := ftpConn.NameList("walk/with space")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(names) != 1 || path.Base(names[0]) != "d e.txt" {
+		t.Errorf("Wrong names: %q", names)
+	}
+}
+
+func TestWalkMLSD(t *testing.T) {
+	internalWalk(t, true)
+}
+
+func TestWalkList(t *testing.T) {
+	internalWalk(t, false)
+}
+
+func TestMirror(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	localDir, err := ioutil.TempDir("", "ftp-mirror")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+
+	modTime := time.Date(2018, 3, 12, 11, 30, 45, 0, time.UTC)
+	files := []string{"a.txt", "sub/b.txt", "sub/skip.log", "vendor/c.txt"}
+	for _, file := range files {
+		localPath := filepath.Join(localDir, filepath.FromSlash(file))
+		if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+		if err = ioutil.WriteFile(localPath, []byte(file), 0644); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+		if err = os.Chtimes(localPath, modTime, modTime); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+	}
+	defer func() {
+		ftpConn.DeleteFile("mirror/a.txt")
+		ftpConn.DeleteFile("mirror/sub/b.txt")
+		ftpConn.DeleteDir("mirror/sub")
+		ftpConn.DeleteDir("mirror")
+	}()
+
+	opts := &MirrorOptions{
+		Mode:          PassiveMode,
+		Exclude:       []string{"*.log", "vendor"},
+		PreserveTimes: true,
+		SkipSame:      true,
+	}
+
+	report, err := ftpConn.UploadDir(localDir, "mirror", &MirrorOptions{Exclude: opts.Exclude, DryRun: true})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, _, err = ftpConn.Size("mirror/a.txt"); err == nil {
+		t.Errorf("Dry run has uploaded a file")
+	}
+
+	expected := &MirrorReport{
+		Dirs:        []string{".", "sub"},
+		Transferred: []string{"a.txt", "sub/b.txt"},
+		Excluded:    []string{"sub/skip.log", "vendor"},
+		Bytes:       int64(len("a.txt") + len("sub/b.txt")),
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Wrong dry run report, expected %+v, got %+v", expected, report)
+	}
+
+	if report, err = ftpConn.UploadDir(localDir, "mirror", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Wrong upload report, expected %+v, got %+v", expected, report)
+	}
+	_, remoteTime, err := ftpConn.LastModificationTime("mirror/sub/b.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !remoteTime.Equal(modTime) {
+		t.Errorf("Modification time not preserved, expected %s, got %s", modTime, remoteTime)
+	}
+
+	// everything is already there.
+	if report, err = ftpConn.UploadDir(localDir, "mirror", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(report.Transferred) != 0 || len(report.Skipped) != 2 || len(report.Dirs) != 0 {
+		t.Errorf("Wrong upload report: %+v", report)
+	}
+
+	downloadDir := filepath.Join(localDir, "download")
+	opts.Include = []string{"b.txt"}
+	if report, err = ftpConn.DownloadDir("mirror", downloadDir, opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	expected = &MirrorReport{
+		Dirs:        []string{".", "sub"},
+		Transferred: []string{"sub/b.txt"},
+		Excluded:    []string{"a.txt"},
+		Bytes:       int64(len("sub/b.txt")),
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Wrong download report, expected %+v, got %+v", expected, report)
+	}
+	downloaded := filepath.Join(downloadDir, "sub", "b.txt")
+	content, err := ioutil.ReadFile(downloaded)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if string(content) != "sub/b.txt" {
+		t.Errorf("Wrong content: %s", content)
+	}
+	if info, err := os.Stat(downloaded); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("Modification time not preserved: %v", err)
+	}
+
+	if report, err = ftpConn.DownloadDir("mirror", downloadDir, opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(report.Transferred) != 0 || len(report.Skipped) != 1 || len(report.Dirs) != 0 {
+		t.Errorf("Wrong download report: %+v", report)
+	}
+}
+
+func TestMirrorPreserveTimesError(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "ftp-mirror")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+	if err = ioutil.WriteFile(filepath.Join(localDir, "a.txt"), []byte("a.txt"), 0644); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	// the listing is empty, and what is stored is discarded.
+	dataListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer dataListener.Close()
+	go func() {
+		for {
+			conn, err := dataListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*net.TCPConn).CloseWrite()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	port := dataListener.Addr().(*net.TCPAddr).Port
+	// a 4xx reply is not a failure for getFtpResponse.
+	for _, test := range []struct {
+		mfmt string
+		code int
+	}{
+		{"550 Permission denied", FileActionNotTaken},
+		{"451 Local error", 451},
+	} {
+		listener, err := newStubServer("220 Welcome", map[string]string{
+			"FEAT": "211-Features:\r\n MFMT\r\n MLST type*;\r\n211 End",
+			"TYPE": "200 Type set",
+			"PASV": fmt.Sprintf("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256),
+			"MLST": "250-Listing mirror\r\n type=dir; mirror\r\n250 End",
+			"MLSD": "150 Opening data connection\r\n226 Transfer complete",
+			"STOR": "150 Opening data connection\r\n226 Transfer complete",
+			"MFMT": test.mfmt,
+		})
+		if err != nil {
+			t.Fatalf("Listen error: %s", err.Error())
+		}
+
+		ftpConn, _, err := Dial(listener.Addr().String(), &Config{
+			DefaultMode:    PassiveMode,
+			LocalIP:        net.IP([]byte{127, 0, 0, 1}),
+			CommandTimeout: time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Conn error: %s", err.Error())
+		}
+
+		_, err = ftpConn.UploadDir(localDir, "mirror", &MirrorOptions{PreserveTimes: true})
+		var protocolErr *ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr.Response.Code != test.code {
+			t.Errorf("Expected the reply %s, got: %v", test.mfmt, err)
+		}
+		ftpConn.control.Close()
+		listener.Close()
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		expected bool
+	}{
+		{[]string{"*.go"}, "dir/main.go", true},
+		{[]string{"dir/*"}, "dir/main.go", true},
+		{[]string{"dir"}, "dir", true},
+		{[]string{"*.txt", "other"}, "dir/main.go", false},
+		{nil, "main.go", false},
+	}
+	for _, test := range tests {
+		if got := MatchAny(test.patterns, test.rel); got != test.expected {
+			t.Errorf("MatchAny(%q, %s): expected %t, got %t", test.patterns, test.rel, test.expected, got)
+		}
+	}
+
+	relatives := map[[2]string]string{
+		{"mirror", "mirror"}:        ".",
+		{"mirror/", "mirror/a/b"}:   "a/b",
+		{"/", "/a"}:                 "a",
+		{".", ".hidden/a"}:          ".hidden/a",
+		{"/srv/ftp", "/srv/ftp/.a"}: ".a",
+	}
+	for paths, expected := range relatives {
+		if got := RelativePath(paths[0], paths[1]); got != expected {
+			t.Errorf("RelativePath(%s, %s): expected %s, got %s", paths[0], paths[1], expected, got)
+		}
+	}
+}
+
+func poolConfig() *Config {
+	return &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	}
+}
+
+func TestPool(t *testing.T) {
+	pool, err := NewPool("localhost:2121", poolConfig(), &PoolOptions{Size: 2, MaxConns: 3, HealthCheckInterval: time.Minute})
+	if err != nil {
+		t.Fatalf("Pool error: %s", err.Error())
+	}
+	defer pool.Close()
+
+	ctx := context.Background()
+	var conns []*Conn
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+		conns = append(conns, conn)
+	}
+
+	// they're all in use.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = pool.Acquire(timeoutCtx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// a broken connection is replaced.
+	conns[0].control.Close()
+	pool.Discard(conns[0])
+	pool.Release(conns[1])
+	pool.Release(conns[2])
+	pool.Release(conns[2])
+
+	errChan := make(chan error, 8)
+	for i := 0; i < cap(errChan); i++ {
+		go func(i int) {
+			conn, err := pool.Acquire(ctx)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			defer pool.Release(conn)
+
+			name := "pool" + strconv.Itoa(i) + ".txt"
+			content := strings.Repeat(name, 1000)
+			if err = conn.StoreFrom(ctx, IndMode, name, strings.NewReader(content)); err != nil {
+				errChan <- err
+				return
+			}
+			var buffer bytes.Buffer
+			if err = conn.RetrieveTo(ctx, IndMode, name, &buffer); err == nil && buffer.String() != content {
+				err = errors.New("Wrong content of " + name)
+			}
+			if _, deleteErr := conn.DeleteFile(name); err == nil {
+				err = deleteErr
+			}
+			errChan <- err
+		}(i)
+	}
+	for i := 0; i < cap(errChan); i++ {
+		if err = <-errChan; err != nil {
+			t.Errorf("Got error: %s", err.Error())
+		}
+	}
+
+	// a connection dead while idle is replaced.
+	pool.opts.HealthCheckInterval = 0
+	pool.lock.Lock()
+	for _, idle := range pool.idle {
+		idle.conn.control.Close()
+	}
+	pool.lock.Unlock()
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = conn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	pool.Release(conn)
+
+	if err = pool.Close(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if _, err = pool.Acquire(ctx); err != ErrPoolClosed {
+		t.Errorf("Expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestConcurrentConn(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	ctx := context.Background()
+	errChan := make(chan error, 8)
+	for i := 0; i < cap(errChan); i++ {
+		go func(i int) {
+			name := "concurrent" + strconv.Itoa(i) + ".txt"
+			content := strings.Repeat(name, 1000)
+			if err := ftpConn.StoreFrom(ctx, IndMode, name, strings.NewReader(content)); err != nil {
+				errChan <- err
+				return
+			}
+			if _, _, err := ftpConn.Pwd(); err != nil {
+				errChan <- err
+				return
+			}
+			var buffer bytes.Buffer
+			err := ftpConn.RetrieveTo(ctx, IndMode, name, &buffer)
+			if err == nil && buffer.String() != content {
+				err = errors.New("Wrong content of " + name)
+			}
+			if _, deleteErr := ftpConn.DeleteFile(name); err == nil {
+				err = deleteErr
+			}
+			errChan <- err
+		}(i)
+	}
+	for i := 0; i < cap(errChan); i++ {
+		if err = <-errChan; err != nil {
+			t.Errorf("Got error: %s", err.Error())
+		}
+	}
+
+	// a command waits for the stream to be closed.
+	if err = ftpConn.StoreFrom(ctx, IndMode, "concurrent.txt", strings.NewReader("content")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("concurrent.txt")
+	reader, err := ftpConn.OpenRead("concurrent.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	noopChan := make(chan error, 1)
+	go func() {
+		_, err := ftpConn.Noop()
+		noopChan <- err
+	}()
+	select {
+	case <-noopChan:
+		t.Errorf("Noop not waiting for the stream")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = ioutil.ReadAll(reader); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if err = reader.Close(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if err = <-noopChan; err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	retryable := []error{
+		newUnexpectedCodeError(FileStatusOk, CantOpenDataConn),
+		&ProtocolError{Response: &Response{Code: FileUnavailable}},
+		io.EOF,
+		&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+	}
+	for _, err := range retryable {
+		if !policy.retryable(err) {
+			t.Errorf("Expected %v to be retryable", err)
+		}
+	}
+	permanent := []error{
+		newUnexpectedCodeError(CdOk, 550),
+		&ProtocolError{Response: &Response{Code: 530}},
+		context.Canceled,
+		errors.New("something else"),
+	}
+	for _, err := range permanent {
+		if policy.retryable(err) {
+			t.Errorf("Expected %v not to be retryable", err)
+		}
+	}
+
+	policy.Codes = []int{550}
+	if !policy.retryable(newUnexpectedCodeError(CdOk, 550)) || policy.retryable(newUnexpectedCodeError(FileStatusOk, CantOpenDataConn)) {
+		t.Errorf("Codes not used")
+	}
+
+	for attempt, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := policy.backoff(attempt + 1); got != expected*time.Millisecond {
+			t.Errorf("Wrong backoff of attempt %d, expected %s, got %s", attempt+1, expected*time.Millisecond, got)
+		}
+	}
+}
+
+// dropProxy forwards the connections to the test server,
+// so that they can be dropped as if the server had done it.
+type dropProxy struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+	// commands is what the clients have sent.
+	commands bytes.Buffer
+}
+
+func newDropProxy() (*dropProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &dropProxy{listener: listener}
+	go p.serve()
+	return p, nil
+}
+
+func (p *dropProxy) serve() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", "127.0.0.1:2121")
+		if err != nil {
+			client.Close()
+			continue
+		}
+		p.lock.Lock()
+		p.conns = append(p.conns, client, server)
+		p.lock.Unlock()
+		go func() {
+			io.Copy(server, io.TeeReader(client, writerFunc(p.record)))
+			server.Close()
+		}()
+		go func() {
+			io.Copy(client, server)
+			client.Close()
+		}()
+	}
+}
+
+func (p *dropProxy) record(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.commands.Write(b)
+}
+
+func (p *dropProxy) sent() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.commands.String()
+}
+
+// drop closes the connections open so far.
+func (p *dropProxy) drop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestReconnect(t *testing.T) {
+	proxy, err := newDropProxy()
+	if err != nil {
+		t.Fatalf("Proxy error: %s", err.Error())
+	}
+	defer proxy.listener.Close()
+
+	config := &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+		Retry:       &RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond},
+	}
+	ftpConn, _, err := DialAndAuthenticate(proxy.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	if _, err = ftpConn.MkDir("reconnect"); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = ftpConn.Cd("reconnect"); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	// the working directory is restored.
+	proxy.drop()
+	_, directory, err := ftpConn.Pwd()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if directory != "/reconnect" {
+		t.Errorf("Wrong directory, expected /reconnect, got %s", directory)
+	}
+
+	ctx := context.Background()
+	content := strings.Repeat("reconnect", 1000)
+	if err = ftpConn.StoreFrom(ctx, IndMode, "a.txt", strings.NewReader(content)); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	proxy.drop()
+	var buffer bytes.Buffer
+	if err = ftpConn.RetrieveTo(ctx, IndMode, "a.txt", &buffer); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if buffer.String() != content {
+		t.Errorf("Wrong content: %s", buffer.String())
+	}
+	proxy.drop()
+	if _, err = ftpConn.DeleteFile("a.txt"); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if _, err = ftpConn.Cd("/"); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if _, err = ftpConn.DeleteDir("reconnect"); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+
+	// without a policy the error is returned.
+	config.Retry = nil
+	proxy.drop()
+	if _, _, err = ftpConn.Pwd(); err == nil {
+		t.Errorf("Expected error without RetryPolicy")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	proxy, err := newDropProxy()
+	if err != nil {
+		t.Fatalf("Proxy error: %s", err.Error())
+	}
+	defer proxy.listener.Close()
+
+	config := &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+		KeepAlive:   20 * time.Millisecond,
+	}
+	ftpConn, _, err := DialAndAuthenticate(proxy.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	time.Sleep(100 * time.Millisecond)
+	if !strings.Contains(proxy.sent(), "NOOP") {
+		t.Errorf("No NOOP sent while idle")
+	}
+
+	// a slow download, so that NOOPs are sent meanwhile.
+	ctx := context.Background()
+	content := strings.Repeat("keepalive", 1000)
+	if err = ftpConn.StoreFrom(ctx, IndMode, "keepalive.txt", strings.NewReader(content)); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("keepalive.txt")
+	var buffer bytes.Buffer
+	slowWriter := writerFunc(func(p []byte) (int, error) {
+		time.Sleep(10 * time.Millisecond)
+		return buffer.Write(p)
+	})
+	sent := strings.Count(proxy.sent(), "NOOP")
+	if err = ftpConn.RetrieveTo(ctx, IndMode, "keepalive.txt", slowWriter); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if buffer.String() != content {
+		t.Errorf("Wrong content: %s", buffer.String())
+	}
+	if strings.Count(proxy.sent(), "NOOP") == sent {
+		t.Errorf("No NOOP sent during the transfer")
+	}
+	// the replies to the NOOPs have been consumed.
+	if _, directory, err := ftpConn.Pwd(); err != nil || directory != "/" {
+		t.Errorf("Wrong PWD after the transfer: %s, %v", directory, err)
+	}
+
+	// closed once idle.
+	idleConn, _, err := DialAndAuthenticate("localhost:2121", &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	if _, err = idleConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err = idleConn.Noop(); err == nil {
+		t.Errorf("Expected error on an idle connection")
+	}
+}
+
+// newStubServer listens for a server that sends `greeting`, if any,
+// and replies to each command with the reply in `replies` for the
+// whole line or, if missing, for the command name; the other commands
+// never get a reply.
+func newStubServer(greeting string, replies map[string]string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if greeting != "" {
+					io.WriteString(conn, greeting+"\r\n")
+				}
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fields := strings.Fields(scanner.Text())
+					if len(fields) == 0 {
+						continue
+					}
+					// a whole line is matched before the command.
+					reply, ok := replies[scanner.Text()]
+					if !ok {
+						reply, ok = replies[fields[0]]
+					}
+					if ok {
+						io.WriteString(conn, reply+"\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+func checkTimeout(t *testing.T, err error, phase TimeoutPhase) {
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Errorf("Expected a TimeoutError, got: %v", err)
+		return
+	}
+	if timeoutErr.Phase != phase {
+		t.Errorf("Wrong phase, expected %s, got %s", phase, timeoutErr.Phase)
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Expected a net.Error timeout")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// the server never greets.
+	listener, err := newStubServer("", nil)
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+	_, _, err = Dial(listener.Addr().String(), &Config{
+		DefaultMode: PassiveMode,
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+		DialTimeout: 50 * time.Millisecond,
+	})
+	checkTimeout(t, err, TimeoutDial)
+
+	// data connections are never opened and never used.
+	dataListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer dataListener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := dataListener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	port := dataListener.Addr().(*net.TCPAddr).Port
+	listener, err = newStubServer("220 Welcome", map[string]string{
+		"USER": "331 Password required",
+		"PASS": "230 Logged in",
+		"FEAT": "211 No features",
+		"TYPE": "200 Type set",
+		"PORT": "200 PORT ok",
+		"PASV": fmt.Sprintf("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256),
+		"RETR": "150 Opening data connection",
+	})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+
+	ftpConn, _, err := DialAndAuthenticate(listener.Addr().String(), &Config{
+		DefaultMode:     PassiveMode,
+		Username:        "anonymous",
+		Password:        "c@b.com",
+		LocalIP:         net.IP([]byte{127, 0, 0, 1}),
+		CommandTimeout:  50 * time.Millisecond,
+		DataConnTimeout: 50 * time.Millisecond,
+		StallTimeout:    50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.control.Close()
+
+	_, err = ftpConn.Noop()
+	checkTimeout(t, err, TimeoutCommand)
+
+	ctx := context.Background()
+	err = ftpConn.RetrieveTo(ctx, ActiveMode, "a.txt", ioutil.Discard)
+	checkTimeout(t, err, TimeoutDataConn)
+
+	err = ftpConn.RetrieveTo(ctx, PassiveMode, "a.txt", ioutil.Discard)
+	checkTimeout(t, err, TimeoutStall)
+}
+
+func TestTransferReplyDeadline(t *testing.T) {
+	// the file is empty, but the final reply never comes.
+	dataListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer dataListener.Close()
+	go func() {
+		for {
+			conn, err := dataListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := dataListener.Addr().(*net.TCPAddr).Port
+	listener, err := newStubServer("220 Welcome", map[string]string{
+		"FEAT": "502 Not implemented",
+		"TYPE": "200 Type set",
+		"PASV": fmt.Sprintf("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256),
+		"RETR": "150 Opening data connection",
+	})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+
+	ftpConn, _, err := Dial(listener.Addr().String(), &Config{
+		DefaultMode: PassiveMode,
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.control.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = ftpConn.RetrieveTo(ctx, PassiveMode, "a.txt", ioutil.Discard); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to be exceeded, got: %v", err)
+	}
+}
+
+func TestStreamFinalReply(t *testing.T) {
+	// the data connections are closed as soon as they're open.
+	dataListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer dataListener.Close()
+	go func() {
+		for {
+			conn, err := dataListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := dataListener.Addr().(*net.TCPAddr).Port
+	// the final reply is sent along with the first one.
+	listener, err := newStubServer("220 Welcome", map[string]string{
+		"FEAT": "502 Not implemented",
+		"TYPE": "200 Type set",
+		"PASV": fmt.Sprintf("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256),
+		"RETR": "150 Opening data connection\r\n426 Connection closed, transfer aborted",
+		"STOR": "150 Opening data connection\r\n452 Insufficient storage space",
+	})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+
+	ftpConn, _, err := Dial(listener.Addr().String(), &Config{
+		DefaultMode: PassiveMode,
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.control.Close()
+
+	reader, err := ftpConn.OpenRead("a.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = ioutil.ReadAll(reader); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = reader.Close(); !IsTransient(err) {
+		t.Errorf("Expected a transient error, got: %v", err)
+	}
+
+	writer, err := ftpConn.OpenWrite("a.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = writer.Close(); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("Expected ErrStorageFull, got: %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1000, 0)
+	if rate, burst := limiter.Rate(); rate != 1000 || burst != 1000 {
+		t.Errorf("Wrong rate: %d, %d", rate, burst)
+	}
+	// the burst is free, then the bytes in excess wait.
+	if delay := limiter.reserve(1000); delay != 0 {
+		t.Errorf("Burst should not wait, got %s", delay)
+	}
+	if delay := limiter.reserve(500); delay < 400*time.Millisecond {
+		t.Errorf("Wrong delay: %s", delay)
+	}
+	limiter.SetRate(0, 0)
+	if delay := limiter.reserve(1 << 20); delay != 0 {
+		t.Errorf("No limit should not wait, got %s", delay)
+	}
+	var nilLimiter *RateLimiter
+	if delay := nilLimiter.reserve(1 << 20); delay != 0 {
+		t.Errorf("No limiter should not wait, got %s", delay)
+	}
+
+	limiter.SetRate(50*1024, 1024)
+	config := &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+		RateLimit:   limiter,
+	}
+	ftpConn, _, err := DialAndAuthenticate("localhost:2121", config)
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	ctx := context.Background()
+	content := strings.Repeat("ratelimit", 2000)
+	start := time.Now()
+	if err = ftpConn.StoreFrom(ctx, IndMode, "ratelimit.txt", strings.NewReader(content)); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("ratelimit.txt")
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Upload not limited: %s", elapsed)
+	}
+
+	// the limit of the transfer.
+	limiter.SetRate(0, 0)
+	var buffer bytes.Buffer
+	opts := &TransferOptions{RateLimit: NewRateLimiter(50*1024, 1024)}
+	local := filepath.Join(os.TempDir(), "ratelimit.txt")
+	defer os.Remove(local)
+	start = time.Now()
+	if err = ftpConn.RetrieveContext(ctx, IndMode, "ratelimit.txt", local, opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Download not limited: %s", elapsed)
+	}
+
+	// no limit anymore.
+	start = time.Now()
+	if err = ftpConn.RetrieveTo(ctx, IndMode, "ratelimit.txt", &buffer); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Download limited: %s", elapsed)
+	}
+	if buffer.String() != content {
+		t.Errorf("Wrong content: %s", buffer.String())
+	}
+}
+
+func TestLineConversion(t *testing.T) {
+	// one byte at a time, so that CRLF is split across the chunks.
+	var crlf bytes.Buffer
+	if _, err := io.Copy(&crlf, newLineReader(iotest.OneByteReader(strings.NewReader("a\nb\r\n\nc")), &toCRLF{})); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if crlf.String() != "a\r\nb\r\n\r\nc" {
+		t.Errorf("Wrong CRLF conversion: %q", crlf.String())
+	}
+
+	var lf bytes.Buffer
+	writer := newLineWriter(&lf, &toLF{})
+	for _, b := range []byte("a\r\nb\rc\r\n\r") {
+		writer.Write([]byte{b})
+	}
+	if err := writer.flush(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if lf.String() != "a\nb\rc\n\r" {
+		t.Errorf("Wrong LF conversion: %q", lf.String())
+	}
+}
+
+func TestTransferType(t *testing.T) {
+	ftpConn, _, err := DialAndAuthenticate("localhost:2121", &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+	if ftpConn.serverType != TypeBinary {
+		t.Errorf("Expected binary after the login, got %q", ftpConn.serverType)
+	}
+
+	ctx := context.Background()
+	if _, err = ftpConn.SetType(TypeASCII); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = ftpConn.StoreFrom(ctx, IndMode, "ascii.txt", strings.NewReader("a\nb\r\nc\n")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("ascii.txt")
+
+	// SIZE is sent in binary.
+	_, size, err := ftpConn.Size("ascii.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if size != 9 {
+		t.Errorf("Wrong size, expected 9, got %d", size)
+	}
+
+	reader, err := ftpConn.OpenRead("ascii.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = reader.Close(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if string(content) != "a\nb\nc\n" {
+		t.Errorf("Wrong ASCII content: %q", content)
+	}
+
+	// the type of the transfer wins.
+	var buffer bytes.Buffer
+	local := filepath.Join(os.TempDir(), "ascii.txt")
+	defer os.Remove(local)
+	if err = ftpConn.RetrieveContext(ctx, IndMode, "ascii.txt", local, &TransferOptions{Type: TypeBinary}); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if content, _ = ioutil.ReadFile(local); string(content) != "a\r\nb\r\nc\r\n" {
+		t.Errorf("Wrong binary content: %q", content)
+	}
+	err = ftpConn.RetrieveContext(ctx, IndMode, "ascii.txt", local, &TransferOptions{Resume: true})
+	if err != errResumeASCII {
+		t.Errorf("Expected the resume error, got: %v", err)
+	}
+
+	if _, err = ftpConn.SetType(TypeBinary); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = ftpConn.RetrieveTo(ctx, IndMode, "ascii.txt", &buffer); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if buffer.String() != "a\r\nb\r\nc\r\n" {
+		t.Errorf("Wrong binary content: %q", buffer.String())
+	}
+	if _, err = ftpConn.SetType("E"); err == nil {
+		t.Errorf("Expected error with an invalid type")
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	sum, err := parseHash(strings.Fields("file.txt D9D8DEC2"), crc32.Size)
+	if err != nil || sum != "d9d8dec2" {
+		t.Errorf("Wrong hash: %s, %v", sum, err)
+	}
+	// leading zeros stripped.
+	if sum, err = parseHash([]string{"DEC2"}, crc32.Size); err != nil || sum != "0000dec2" {
+		t.Errorf("Wrong hash: %s, %v", sum, err)
+	}
+	if _, err = parseHash([]string{"d9d8dec2"}, md5.Size); err == nil {
+		t.Errorf("Expected error on a short hash")
+	}
+}
+
+func TestHash(t *testing.T) {
+	ftpConn, _, err := DialAndAuthenticate("localhost:2121", &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	ctx := context.Background()
+	content := strings.Repeat("checksum", 100)
+	local := filepath.Join(os.TempDir(), "checksum.txt")
+	if err = ioutil.WriteFile(local, []byte(content), 0644); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.Remove(local)
+	err = ftpConn.StoreContext(ctx, IndMode, local, "checksum.txt", &TransferOptions{VerifyChecksum: HashSHA1})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("checksum.txt")
+
+	sha256Sum := sha256.Sum256([]byte(content))
+	md5Sum := md5.Sum([]byte(content))
+	sha1Sum := sha1.Sum([]byte(content[2:50]))
+	tailSum := sha1.Sum([]byte(content[50:]))
+	for _, test := range []struct {
+		algo       HashAlgorithm
+		start, end int64
+		expected   []byte
+	}{
+		{HashSHA256, 0, -1, sha256Sum[:]},
+		{HashMD5, 0, -1, md5Sum[:]},
+		{HashSHA1, 2, 50, sha1Sum[:]},
+		{HashSHA1, 50, -1, tailSum[:]},
+	} {
+		sum, err := ftpConn.HashRange("checksum.txt", test.algo, test.start, test.end)
+		if err != nil {
+			t.Errorf("Got error for %s: %s", test.algo, err.Error())
+		} else if sum != hex.EncodeToString(test.expected) {
+			t.Errorf("Wrong %s hash: %s", test.algo, sum)
+		}
+	}
+	if _, err = ftpConn.Hash("checksum.txt", HashAlgorithm("SHA-3")); err == nil {
+		t.Errorf("Expected error with an unknown algorithm")
+	}
+
+	err = ftpConn.RetrieveContext(ctx, IndMode, "checksum.txt", local, &TransferOptions{VerifyChecksum: HashMD5})
+	if err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+
+	tr := &transfer{verifyChecksum: HashMD5}
+	tr.resetChecksum()
+	tr.checksum.Write([]byte("something else"))
+	err = ftpConn.verifyChecksum("checksum.txt", tr, 0, "")
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a ChecksumMismatchError, got: %v", err)
+	}
+	if mismatch.Remote != hex.EncodeToString(md5Sum[:]) {
+		t.Errorf("Wrong remote hash: %s", mismatch.Remote)
+	}
+}
+
+func TestVerifyChecksumWithoutRang(t *testing.T) {
+	content := []byte("resumed download")
+	local := filepath.Join(os.TempDir(), "resumed.txt")
+	if err := ioutil.WriteFile(local, content, 0644); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.Remove(local)
+	sum := sha1.Sum(content)
+
+	listener, err := newStubServer("220 Welcome", map[string]string{
+		"FEAT": "211-Features:\r\n HASH SHA-1*\r\n211 End",
+		"HASH": fmt.Sprintf("213 SHA-1 0-%d %x resumed.txt", len(content)-1, sum),
+		"QUIT": "221 Goodbye",
+	})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+
+	ftpConn, _, err := Dial(listener.Addr().String(), &Config{
+		DefaultMode: PassiveMode,
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	// only the tail of the file has been received.
+	tr := &transfer{verifyChecksum: HashSHA1, transferred: 8}
+	tr.resetChecksum()
+	tr.checksum.Write(content[8:])
+	var featureErr *FeatureNotSupportedError
+	if err = ftpConn.verifyChecksum("resumed.txt", tr, 8, ""); !errors.As(err, &featureErr) {
+		t.Errorf("Expected a FeatureNotSupportedError, got: %v", err)
+	}
+	if err = ftpConn.verifyChecksum("resumed.txt", tr, 8, local); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+func TestSetModificationTime(t *testing.T) {
+	ftpConn, _, err := DialAndAuthenticate("localhost:2121", &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	local := filepath.Join(os.TempDir(), "modtime.txt")
+	if err = ioutil.WriteFile(local, []byte("modtime"), 0644); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.Remove(local)
+	if err = os.Chtimes(local, modTime, modTime); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	ctx := context.Background()
+	err = ftpConn.StoreContext(ctx, IndMode, local, "modtime.txt", &TransferOptions{PreserveTimes: true})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("modtime.txt")
+	_, remoteTime, err := ftpConn.LastModificationTime("modtime.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !remoteTime.Equal(modTime) {
+		t.Errorf("Wrong remote time: %s", remoteTime)
+	}
+
+	newTime := modTime.Add(time.Hour)
+	if _, err = ftpConn.SetModificationTime("modtime.txt", newTime); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	err = ftpConn.RetrieveContext(ctx, IndMode, "modtime.txt", local, &TransferOptions{PreserveTimes: true})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !info.ModTime().Equal(newTime) {
+		t.Errorf("Wrong local time: %s", info.ModTime())
+	}
+
+	// falling back to SITE UTIME, but not on a missing file.
+	// "MDTM modtime.txt" is the query of the time, the
+	// servers that can't set it reply 550 to the other MDTM.
+	for _, test := range []struct {
+		feat     string
+		mfmt     string
+		mdtm     string
+		query    string
+		site     string
+		expected error
+	}{
+		{"MDTM\r\n MFMT", "500 Unknown command", "501 Syntax error", "213 20010203040506", "200 UTIME ok", nil},
+		{"MDTM\r\n MFMT", "500 Unknown command", "501 Syntax error", "213 20010203040506", "502 Unknown command", &FeatureNotSupportedError{}},
+		{"MDTM\r\n MFMT", "550 No such file", "501 Syntax error", "213 20010203040506", "200 UTIME ok", &ProtocolError{}},
+		{"MDTM", "", "550 No such file", "213 20010203040506", "200 UTIME ok", nil},
+		{"MDTM", "", "550 No such file", "550 No such file", "200 UTIME ok", &ProtocolError{}},
+	} {
+		listener, err := newStubServer("220 Welcome", map[string]string{
+			"USER":             "331 Password required",
+			"PASS":             "230 Logged in",
+			"TYPE":             "200 Type set",
+			"FEAT":             "211-Features:\r\n " + test.feat + "\r\n211 End",
+			"MFMT":             test.mfmt,
+			"MDTM":             test.mdtm,
+			"MDTM modtime.txt": test.query,
+			"SITE":             test.site,
+		})
+		if err != nil {
+			t.Fatalf("Listen error: %s", err.Error())
+		}
+		stubConn, _, err := DialAndAuthenticate(listener.Addr().String(), &Config{
+			DefaultMode:    PassiveMode,
+			Username:       "anonymous",
+			Password:       "c@b.com",
+			LocalIP:        net.IP([]byte{127, 0, 0, 1}),
+			CommandTimeout: time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Conn error: %s", err.Error())
+		}
+		response, err := stubConn.SetModificationTime("modtime.txt", modTime)
+		if test.expected == nil && (err != nil || response.Code != SiteOk) {
+			t.Errorf("Expected SITE UTIME to be used, got %v, %v", response, err)
+		}
+		if test.expected != nil && reflect.TypeOf(err) != reflect.TypeOf(test.expected) {
+			t.Errorf("Expected %T, got %v", test.expected, err)
+		}
+		stubConn.control.Close()
+		listener.Close()
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	tests := []struct {
+		err       error
+		sentinel  error
+		transient bool
+		permanent bool
+	}{
+		{newProtocolError(0, &Response{Code: 550}), ErrNotFound, false, true},
+		{newProtocolError(0, &Response{Code: 530}), ErrPermissionDenied, false, true},
+		{newProtocolError(0, &Response{Code: 534}), ErrPermissionDenied, false, true},
+		{newProtocolError(0, &Response{Code: 502}), ErrNotImplemented, false, true},
+		{newProtocolError(OptsOk, &Response{Code: 504}), ErrNotImplemented, false, true},
+		{newProtocolError(CdOk, &Response{Code: 421}), ErrServiceUnavailable, true, false},
+		{newProtocolError(TransferOk, &Response{Code: 452}), ErrStorageFull, true, false},
+		{newProtocolError(TransferOk, &Response{Code: 552}), ErrStorageFull, false, true},
+		{newProtocolError(FileStatusOk, &Response{Code: 226}), nil, false, false},
+	}
+	for _, test := range tests {
+		wrapped := fmt.Errorf("wrapped: %w", test.err)
+		for _, sentinel := range []error{ErrNotFound, ErrPermissionDenied, ErrNotImplemented, ErrServiceUnavailable, ErrStorageFull} {
+			if errors.Is(wrapped, sentinel) != (sentinel == test.sentinel) {
+				t.Errorf("%s: errors.Is(%s) should be %t", test.err, sentinel, sentinel == test.sentinel)
+			}
+		}
+		if IsTransient(wrapped) != test.transient || IsPermanent(wrapped) != test.permanent {
+			t.Errorf("%s: wrong class, transient %t, permanent %t", test.err, IsTransient(wrapped), IsPermanent(wrapped))
+		}
+	}
+
+	// the expected code is still available as an *UnexpectedCodeError.
+	var codeErr *UnexpectedCodeError
+	if !errors.As(newProtocolError(CdOk, &Response{Code: 550}), &codeErr) || codeErr.Expected != CdOk || codeErr.Got != 550 {
+		t.Errorf("Expected an *UnexpectedCodeError, got %v", codeErr)
+	}
+	if errors.As(newProtocolError(0, &Response{Code: 550}), &codeErr) {
+		t.Errorf("Expected no *UnexpectedCodeError")
+	}
+
+	ftpConn, _, err := DialAndAuthenticate("localhost:2121", &Config{
+		DefaultMode: PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	_, err = ftpConn.Cd("not-existing-dir")
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) || protocolErr.Command != "CWD" || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a CWD ProtocolError matching ErrNotFound, got %v", err)
+	}
+	if _, _, err = ftpConn.Pwd(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+}
+
+func TestRFC959Commands(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	if _, err = ftpConn.MkDir("rfc959"); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteDir("rfc959")
+	if err = ftpConn.StoreFrom(context.Background(), PassiveMode, "rfc959/file.txt",
+		strings.NewReader("content")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer ftpConn.DeleteFile("rfc959/file.txt")
+
+	_, home, err := ftpConn.Pwd()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = ftpConn.Cd("rfc959"); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = ftpConn.CdUp(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, dir, err := ftpConn.Pwd(); err != nil || dir != home {
+		t.Errorf("Expected to be back in %s, got %s, %v", home, dir, err)
+	}
+
+	if _, system, err := ftpConn.System(); err != nil || system != "UNIX" {
+		t.Errorf("Expected UNIX, got %s, %v", system, err)
+	}
+
+	response, err := ftpConn.Status()
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(response.Lines) < 2 {
+		t.Errorf("Wrong status: %v", response.Lines)
+	}
+	entries, err := ftpConn.StatusEntries("rfc959")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(entries) != 1 || entries[0].Name != "file.txt" || entries[0].Size != 7 {
+		t.Errorf("Wrong entries: %+v", entries)
+	}
+
+	if response, err = ftpConn.Help(""); err != nil || len(response.Lines) < 2 {
+		t.Errorf("Wrong help: %v, %v", response, err)
+	}
+	if _, err = ftpConn.SiteChmod("rfc959/file.txt", 0644); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	if response, err = ftpConn.Allocate(7); err != nil || response.Code != Superfluous {
+		t.Errorf("Expected ALLO to be superfluous, got %v, %v", response, err)
+	}
+	if _, err = ftpConn.MountStructure("rfc959"); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("Expected ErrNotImplemented, got %v", err)
+	}
+
+	if _, err = ftpConn.Reinitialize(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = ftpConn.Authenticate(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+
+	// the account is sent when the server asks for it.
+	listener, err := newStubServer("220 Welcome", map[string]string{
+		"USER": "331 Password required",
+		"PASS": "332 Need account",
+		"ACCT": "230 Logged in",
+		"TYPE": "200 Type set",
+	})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err.Error())
+	}
+	defer listener.Close()
+	stubConn, _, err := DialAndAuthenticate(listener.Addr().String(), &Config{
+		DefaultMode:    PassiveMode,
+		Username:       "anonymous",
+		Password:       "c@b.com",
+		Account:        "account",
+		LocalIP:        net.IP([]byte{127, 0, 0, 1}),
+		CommandTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer stubConn.control.Close()
+	if !stubConn.loggedIn {
+		t.Errorf("Expected to be logged in")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer ftpConn.Quit()
+
+	response, err := ftpConn.Command("SYST")
+	if err != nil || response.Code != SystOk {
+		t.Errorf("Wrong SYST reply: %v, %v", response, err)
+	}
+	if _, err = ftpConn.CommandExpect([]int{SystOk}, "SYST"); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+	var codeErr *UnexpectedCodeError
+	_, err = ftpConn.CommandExpect([]int{NoopOk, CdOk}, "SYST")
+	if !errors.As(err, &codeErr) || codeErr.Expected != NoopOk || codeErr.Got != SystOk {
+		t.Errorf("Expected an *UnexpectedCodeError, got %v", err)
+	}
+	if _, err = ftpConn.Command("CWD %s", "not-existing-dir"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	for _, arg := range []string{"dir\r\nDELE file", "dir\nDELE file", "dir\r"} {
+		if _, err = ftpConn.Command("CWD %s", arg); err != ErrInvalidCommand {
+			t.Errorf("%q: expected ErrInvalidCommand, got %v", arg, err)
+		}
+	}
+	for _, cmd := range []string{
+		"RETR a.txt", "list", "REST 100", "MODE B", "STRU R",
+		"AUTH TLS", "CCC", "PBSZ 0", "PROT P",
+		"USER other", "PASS secret", "REIN", "QUIT",
+	} {
+		if _, err = ftpConn.Command("%s", cmd); err != ErrReservedCommand {
+			t.Errorf("%q: expected ErrReservedCommand, got %v", cmd, err)
+		}
+	}
+	// nothing has been sent.
+	if _, err = ftpConn.Noop(); err != nil {
+		t.Errorf("Got error: %s", err.Error())
+	}
+}
+
+func TestFeatures(t *testing.T) {
+
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+
+	defer ftpConn.Quit()
+
+	features, err := ftpConn.Features()
+	if err != nil {
+		t.Errorf("Got error: %s", err.Error())
+		return
+	}
+
+	t.Logf("Features: %+v", features)
+}
+
+func TestBufferSize(t *testing.T) {
+
+	ftpConn, _, err := authenticatedConn()
+	if err != nil {
+		t.Error(err.Error())
 		return
 	}
 
@@ -17,7 +17,10 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nbena/ftp"
 )
@@ -40,9 +43,25 @@ var (
 	mv      = "mv"
 	put     = "put"
 	get     = "get"
+	mput    = "mput"
+	mget    = "mget"
 	rm      = "rm"
 	setMode = "set-mode"
 	getMode = "get-mode"
+	setRate = "set-rate"
+	cdup    = "cdup"
+	system  = "system"
+	rstatus = "rstatus"
+	rhelp   = "rhelp"
+	site    = "site"
+	chmod   = "chmod"
+	umask   = "umask"
+	idle    = "idle"
+	allo    = "allo"
+	smnt    = "smnt"
+	account = "account"
+	reinit  = "reinit"
+	quote   = "quote"
 	help    = "help"
 
 	authSSLHelp = "start an SSL connection"
@@ -57,9 +76,25 @@ var (
 	mvHelp      = "mv <from> <to>"
 	putHelp     = "put <local-file> <remote-destination> upload <local-file> to server using <remote-destination>"
 	getHelp     = "get <remote-file> <local-destination> download <remote-file> to <local-destination>"
+	mputHelp    = "mput [-r] <local-dir> <remote-dir> upload the content of <local-dir> to <remote-dir>"
+	mgetHelp    = "mget [-r] <remote-dir> <local-dir> download the content of <remote-dir> to <local-dir>"
 	rmHelp      = "rm <file> delete remote file/directory"
-	setModeHelp = "set-mode active|passive sets the mode to use for the next transfers"
+	setModeHelp = "set-mode active|passive|extended-active|extended-passive sets the mode to use for the next transfers"
 	getModeHelp = "get-mode shows the current use FTP mode"
+	setRateHelp = "set-rate <rate> limits the transfers to <rate> bytes per second, e.g. 100K, 0 means no limit"
+	cdupHelp    = "cdup moving to the parent directory"
+	systemHelp  = "system show the system type of the server"
+	rstatusHelp = "rstatus [path] show the status of the server, or list [path] over the control connection"
+	rhelpHelp   = "rhelp [command] show the help of the server about [command] or every command"
+	siteHelp    = "site <args> send a SITE command with <args>, e.g. 'site chmod 644 file'"
+	chmodHelp   = "chmod <mode> <file> change the permissions of <file> to the octal <mode>"
+	umaskHelp   = "umask <mask> set the octal umask of the files created on the server"
+	idleHelp    = "idle <seconds> set the idle timeout of the server"
+	alloHelp    = "allo <bytes> reserve <bytes> for the next upload"
+	smntHelp    = "smnt <path> mount the file system structure <path>"
+	accountHelp = "account <account> send the account for the login or the files"
+	reinitHelp  = "reinit reset the session and log in again"
+	quoteHelp   = "quote <command> send <command> as it is, e.g. 'quote CLNT go-ftp'"
 	helpHelp    = "show this message"
 
 	unrecognizedCmd = "unrecognized command, type 'help' to view a list of available commands, or 'help <cmd>' for specific help"
@@ -85,11 +120,27 @@ var (
 		mv:      &helpEntry{help: mvHelp, isLong: false},
 		put:     &helpEntry{help: putHelp, isLong: false},
 		get:     &helpEntry{help: getHelp, isLong: false},
+		mput:    &helpEntry{help: mputHelp, isLong: false},
+		mget:    &helpEntry{help: mgetHelp, isLong: false},
 		rm:      &helpEntry{help: rmHelp, isLong: false},
 		help:    &helpEntry{help: helpHelp, isLong: false},
 		setMode: &helpEntry{help: setModeHelp, isLong: true},
 		getMode: &helpEntry{help: getModeHelp, isLong: true},
+		setRate: &helpEntry{help: setRateHelp, isLong: true},
 		cd:      &helpEntry{help: cdHelp, isLong: false},
+		cdup:    &helpEntry{help: cdupHelp, isLong: false},
+		system:  &helpEntry{help: systemHelp, isLong: false},
+		rstatus: &helpEntry{help: rstatusHelp, isLong: false},
+		rhelp:   &helpEntry{help: rhelpHelp, isLong: false},
+		site:    &helpEntry{help: siteHelp, isLong: false},
+		chmod:   &helpEntry{help: chmodHelp, isLong: false},
+		umask:   &helpEntry{help: umaskHelp, isLong: false},
+		idle:    &helpEntry{help: idleHelp, isLong: false},
+		allo:    &helpEntry{help: alloHelp, isLong: false},
+		smnt:    &helpEntry{help: smntHelp, isLong: false},
+		account: &helpEntry{help: accountHelp, isLong: false},
+		reinit:  &helpEntry{help: reinitHelp, isLong: false},
+		quote:   &helpEntry{help: quoteHelp, isLong: false},
 	}
 )
 
@@ -119,6 +170,44 @@ type cmd struct {
 	// function ftpFunction
 }
 
+// hasMLST returns true if the server advertises MLST,
+// so that the machine readable listings can be used.
+func hasMLST(ftpConn *ftp.Conn) bool {
+	features, err := ftpConn.Features()
+	return err == nil && features.Has("MLST")
+}
+
+// mlsd lists `path` with MLSD, one row per entry.
+func mlsd(ftpConn *ftp.Conn, path string) ([]string, error) {
+	entries, err := ftpConn.MLSD(path)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.Type == ftp.EntryCurrentDir || entry.Type == ftp.EntryParentDir {
+			continue
+		}
+		dirs = append(dirs, fmt.Sprintf("%-7s %12d %s %s",
+			entry.Type,
+			entry.Size,
+			entry.ModTime.Format("Jan _2 2006 15:04"),
+			entry.Name))
+	}
+	return dirs, nil
+}
+
+// mirrorResult summarizes the report of mput and mget.
+func mirrorResult(report *ftp.MirrorReport, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("%d files transferred (%d bytes), %d directories created",
+		len(report.Transferred),
+		report.Bytes,
+		len(report.Dirs)), nil
+}
+
 func (c *cmd) apply(
 	ftpConn *ftp.Conn,
 	returnAsString bool,
@@ -145,6 +234,19 @@ func (c *cmd) apply(
 	case getMode:
 		mode := ftpConn.Mode()
 		return mode, nil
+	case cdup:
+		return ftpConn.CdUp()
+	case system:
+		_, systemType, err := ftpConn.System()
+		if err != nil {
+			return nil, err
+		}
+		return systemType, nil
+	case reinit:
+		if _, err := ftpConn.Reinitialize(); err != nil {
+			return nil, err
+		}
+		return ftpConn.Authenticate()
 
 		// 1 arg
 	case setMode:
@@ -154,9 +256,30 @@ func (c *cmd) apply(
 		}
 		ftpConn.SetDefaultMode(mode)
 		return nil, nil
+	case setRate:
+		rate, err := parseRate(c.args[0])
+		if err != nil {
+			return nil, err
+		}
+		rateLimiter.SetRate(rate, 0)
+		return nil, nil
 	case cd:
 		return ftpConn.Cd(c.args[0])
 	case info:
+		if hasMLST(ftpConn) {
+			entry, err := ftpConn.MLST(c.args[0])
+			if err != nil {
+				return nil, err
+			}
+			if returnAsString {
+				return []interface{}{fmt.Sprintf("Type: %s, size: %d, last modified: %s, perm: %s",
+					entry.Type,
+					entry.Size,
+					entry.ModTime.String(),
+					entry.Perm)}, nil
+			}
+			return []interface{}{int(entry.Size), &entry.ModTime}, nil
+		}
 		_, size, err := ftpConn.Size(c.args[0])
 		if err != nil {
 			return nil, err
@@ -183,6 +306,13 @@ func (c *cmd) apply(
 		// errChan := args[1].(chan error)
 		var dirs []string
 		var err error
+		if hasMLST(ftpConn) {
+			path := ""
+			if len(c.args) > 0 {
+				path = c.args[0]
+			}
+			return mlsd(ftpConn, path)
+		}
 		if len(c.args) == 0 {
 			// ftpConn.Ls(ftp.IndMode, doneChan, errChan)
 			dirs, err = ftpConn.LsSimple(ftp.IndMode)
@@ -196,10 +326,69 @@ func (c *cmd) apply(
 		return dirs, err
 	case mkdir:
 		return ftpConn.MkDir(c.args[0])
+	case rstatus:
+		if len(c.args) == 0 {
+			response, err := ftpConn.Status()
+			if err != nil {
+				return nil, err
+			}
+			return strings.Join(response.Lines, "\n"), nil
+		}
+		lines, err := ftpConn.StatusList(c.args[0])
+		if err != nil {
+			return nil, err
+		}
+		return strings.Join(lines, "\n"), nil
+	case rhelp:
+		command := ""
+		if len(c.args) > 0 {
+			command = c.args[0]
+		}
+		response, err := ftpConn.Help(command)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Join(response.Lines, "\n"), nil
+	case site:
+		return ftpConn.Site(c.args[0])
+	case quote:
+		response, err := ftpConn.Command("%s", c.args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("%d: %s", response.Code, strings.Join(response.Lines, "\n")), nil
+	case umask:
+		mask, err := strconv.ParseUint(c.args[0], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid umask: %s", c.args[0])
+		}
+		return ftpConn.SiteUmask(os.FileMode(mask))
+	case idle:
+		seconds, err := strconv.Atoi(c.args[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid idle timeout: %s", c.args[0])
+		}
+		return ftpConn.SiteIdle(time.Duration(seconds) * time.Second)
+	case allo:
+		size, err := strconv.ParseInt(c.args[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size: %s", c.args[0])
+		}
+		return ftpConn.Allocate(size)
+	case smnt:
+		return ftpConn.MountStructure(c.args[0])
+	case account:
+		return ftpConn.Account(c.args[0])
 
 		// 2 arg
 	case mv:
 		return ftpConn.Rename(c.args[0], c.args[1])
+	case chmod:
+		mode, err := strconv.ParseUint(c.args[0], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mode: %s", c.args[0])
+		}
+		return ftpConn.SiteChmod(c.args[1], os.FileMode(mode))
 
 	case put:
 		doneChan := args[0].(chan struct{})
@@ -245,6 +434,12 @@ func (c *cmd) apply(
 			bufferSize,
 		)
 		// n
+	case mput:
+		report, err := ftpConn.UploadDir(c.args[0], c.args[1], nil)
+		return mirrorResult(report, err)
+	case mget:
+		report, err := ftpConn.DownloadDir(c.args[0], c.args[1], nil)
+		return mirrorResult(report, err)
 	case rm:
 		var responses []*ftp.Response
 		for _, filename := range c.args {
@@ -292,6 +487,16 @@ func parseZeroArg(s string) (*cmd, error) {
 		command = commandLs
 	case getMode:
 		command = commandGetMode
+	case cdup:
+		command = commandCdUp
+	case system:
+		command = commandSystem
+	case rstatus:
+		command = commandRstatus
+	case rhelp:
+		command = commandRhelp
+	case reinit:
+		command = commandReinit
 	default:
 		err = fmt.Errorf("Unknown command or wrong parameters: %s", s)
 	}
@@ -314,6 +519,22 @@ func parseOneArg(first, second string) (*cmd, error) {
 		command = commandRm
 	case setMode:
 		command = commandSetMode
+	case setRate:
+		command = commandSetRate
+	case rstatus:
+		command = commandRstatus
+	case rhelp:
+		command = commandRhelp
+	case umask:
+		command = commandUmask
+	case idle:
+		command = commandIdle
+	case allo:
+		command = commandAllo
+	case smnt:
+		command = commandSmnt
+	case account:
+		command = commandAccount
 	default:
 		err = fmt.Errorf("Unknown command or wrong parameters: %s", first)
 	}
@@ -335,6 +556,12 @@ func parseTwoArg(first, second, third string) (*cmd, error) {
 		command = commandGet
 	case put:
 		command = commandPut
+	case mput:
+		command = commandMput
+	case mget:
+		command = commandMget
+	case chmod:
+		command = commandChmod
 	default:
 		err = fmt.Errorf("Unknown command or wrong parameters: %s", first)
 	}
@@ -344,6 +571,15 @@ func parseTwoArg(first, second, third string) (*cmd, error) {
 	return &command, err
 }
 
+// parseThreeArg parses the recursive transfers, where
+// `second` is the -r flag, which is the default.
+func parseThreeArg(first, second, third, fourth string) (*cmd, error) {
+	if (first != mput && first != mget) || second != "-r" {
+		return nil, fmt.Errorf("Unknown command or wrong parameters: %s", first)
+	}
+	return parseTwoArg(first, third, fourth)
+}
+
 // func parseNArg(first string, others []string) (*cmd, error) {
 // 	var command cmd
 // 	var err error
@@ -372,6 +608,19 @@ func parseTwoArg(first, second, third string) (*cmd, error) {
 func parse(s string) (*cmd, error) {
 	var cmd *cmd
 	var err error
+	// the arguments of site and quote are sent as they are.
+	if parsed := strings.SplitN(s, " ", 2); len(parsed) == 2 {
+		switch parsed[0] {
+		case site:
+			command := commandSite
+			command.args = []string{parsed[1]}
+			return &command, nil
+		case quote:
+			command := commandQuote
+			command.args = []string{parsed[1]}
+			return &command, nil
+		}
+	}
 	if strings.LastIndex(s, " ") == -1 {
 		cmd, err = parseZeroArg(s)
 	} else if strings.Count(s, " ") == 1 {
@@ -380,6 +629,9 @@ func parse(s string) (*cmd, error) {
 	} else if strings.Count(s, " ") == 2 {
 		parsed := strings.Split(s, " ")
 		cmd, err = parseTwoArg(parsed[0], parsed[1], parsed[2])
+	} else if strings.Count(s, " ") == 3 {
+		parsed := strings.Split(s, " ")
+		cmd, err = parseThreeArg(parsed[0], parsed[1], parsed[2], parsed[3])
 	} else {
 		// parsed := strings.Split(s, " ")
 		// if len(parsed) <= 2 {
@@ -499,6 +751,16 @@ var (
 		required: true,
 		n:        -1,
 	}
+	commandMput = cmd{
+		cmd:      "mput",
+		required: true,
+		n:        2,
+	}
+	commandMget = cmd{
+		cmd:      "mget",
+		required: true,
+		n:        2,
+	}
 	commandSetMode = cmd{
 		cmd:      "set-mode",
 		required: true,
@@ -509,6 +771,76 @@ var (
 		required: false,
 		n:        0,
 	}
+	commandSetRate = cmd{
+		cmd:      "set-rate",
+		required: true,
+		n:        1,
+	}
+	commandCdUp = cmd{
+		cmd:      "cdup",
+		required: false,
+		n:        0,
+	}
+	commandSystem = cmd{
+		cmd:      "system",
+		required: false,
+		n:        0,
+	}
+	commandRstatus = cmd{
+		cmd:      "rstatus",
+		required: false,
+		n:        1,
+	}
+	commandRhelp = cmd{
+		cmd:      "rhelp",
+		required: false,
+		n:        1,
+	}
+	commandSite = cmd{
+		cmd:      "site",
+		required: true,
+		n:        -1,
+	}
+	commandChmod = cmd{
+		cmd:      "chmod",
+		required: true,
+		n:        2,
+	}
+	commandUmask = cmd{
+		cmd:      "umask",
+		required: true,
+		n:        1,
+	}
+	commandIdle = cmd{
+		cmd:      "idle",
+		required: true,
+		n:        1,
+	}
+	commandAllo = cmd{
+		cmd:      "allo",
+		required: true,
+		n:        1,
+	}
+	commandSmnt = cmd{
+		cmd:      "smnt",
+		required: true,
+		n:        1,
+	}
+	commandAccount = cmd{
+		cmd:      "account",
+		required: true,
+		n:        1,
+	}
+	commandReinit = cmd{
+		cmd:      "reinit",
+		required: false,
+		n:        0,
+	}
+	commandQuote = cmd{
+		cmd:      "quote",
+		required: true,
+		n:        -1,
+	}
 
 	// commandsTable map[string]cmd
 	// longCommands  []string
@@ -23,6 +23,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nbena/ftp"
 )
@@ -48,6 +49,14 @@ var (
 	deleteIfAbort   bool
 	alwaysPwd       bool
 	asyncDownload   bool
+	keepAlive       time.Duration
+	dialTimeout     time.Duration
+	commandTimeout  time.Duration
+	dataTimeout     time.Duration
+	stallTimeout    time.Duration
+	limitRate       string
+	// rateLimiter limits all the transfers, set-rate changes it.
+	rateLimiter = ftp.NewRateLimiter(0, 0)
 
 	ftpDefaultMode ftp.Mode
 
@@ -57,7 +66,7 @@ var (
 func parseFlags() {
 	flag.StringVar(&localIP, "local-address", "localhost:5354", "the address:port which the client binds in")
 	flag.StringVar(&remote, "remote", "localhost:2121", "name:port of ftp server")
-	flag.StringVar(&defaultMode, "connection-mode", "passive", "the ftp mode, allowed: passive|active|default")
+	flag.StringVar(&defaultMode, "connection-mode", "passive", "the ftp mode, allowed: passive|active|extended-passive|extended-active|default")
 	flag.StringVar(&username, "username", "anonymous", "the username")
 	flag.StringVar(&password, "password", "c@b.com", "the password")
 	flag.BoolVar(&implicitTLS, "tls-implicit", false, "use implicit TLS")
@@ -70,6 +79,12 @@ func parseFlags() {
 	flag.StringVar(&commands, "commands", "", "list of semicolon-separated commands to be executed")
 	// flag.StringVar(&anonymous, "anonymous-ftp", true, "use anonym")
 	flag.BoolVar(&alwaysPwd, "always-run-pwd", true, "after every CD run an LS too show the current directory in prompt")
+	flag.DurationVar(&keepAlive, "keepalive", 0, "interval of the NOOPs that keep the control connection alive, 0 disables them")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 0, "timeout of the connection to the server, 0 means no timeout")
+	flag.DurationVar(&commandTimeout, "command-timeout", 0, "timeout of each reply of the server, 0 means no timeout")
+	flag.DurationVar(&dataTimeout, "data-timeout", 0, "timeout of the opening of each data connection, 0 means no timeout")
+	flag.DurationVar(&stallTimeout, "stall-timeout", 0, "fail a transfer when no bytes are moved for this long, 0 means never")
+	flag.StringVar(&limitRate, "limit-rate", "", "maximum transfer rate in bytes per second, with an optional K, M or G suffix")
 	// flag.BoolVar(&asyncDownload, "async-download", true, "when down/uploading a file, use a background transfering")
 
 	flag.Parse()
@@ -81,26 +96,37 @@ func parseFlags() {
 	// now checking
 	var err error
 
-	if defaultMode != "passive" && defaultMode != "active" && defaultMode != "default" {
+	if defaultMode != "passive" && defaultMode != "active" &&
+		defaultMode != "extended-passive" && defaultMode != "extended-active" &&
+		defaultMode != "default" {
 		fmt.Fprintf(os.Stderr, "Unknow option for \"connection-mode\": %s", defaultMode)
 		os.Exit(1)
 	}
 
 	ftpDefaultMode, err = ftp.GetMode(defaultMode)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
+		fmt.Fprint(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 	if ftpDefaultMode == ftp.IndMode {
 		ftpDefaultMode = ftp.PassiveMode
 	}
 
+	if limitRate != "" {
+		rate, err := parseRate(limitRate)
+		if err != nil {
+			fmt.Fprint(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		rateLimiter.SetRate(rate, 0)
+	}
+
 	serverName = strings.Split(remote, ":")[0]
 
 	// if commands != "" {
 	// 	parsedCommands, err = parseAllCommands(commands)
 	// 	if err != nil {
-	// 		fmt.Fprintf(os.Stderr, err.Error())
+	// 		fmt.Fprint(os.Stderr, err.Error())
 	// 		os.Exit(1)
 	// 	}
 	// }
@@ -141,3 +167,27 @@ func parseFlags() {
 		os.Exit(1)
 	}
 }
+
+// parseRate parses a rate in bytes per second, such as 500, 100K or 2M.
+func parseRate(s string) (int, error) {
+	if s == "" {
+		return 0, fmt.Errorf("Invalid rate: %s", s)
+	}
+	multiplier := 1
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	rate, err := strconv.Atoi(s)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("Invalid rate: %s", s)
+	}
+	return rate * multiplier, nil
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -28,6 +29,12 @@ import (
 )
 
 func getConn() (*ftp.Conn, *ftp.Response, error) {
+	return getConnFromPort(localPortParsed)
+}
+
+// getConnFromPort is like getConn, but the control connection
+// is bound to `localPort`, 0 means any port.
+func getConnFromPort(localPort int) (*ftp.Conn, *ftp.Response, error) {
 	// USER MUST HAVE TO SPECIFY SKIP VERIFY EVEN
 	// IF HE DOESN'T WANT TO CONNECT USING TLS,
 	// BECAUSE IT MAY WANT TO USE IT LATER.
@@ -41,11 +48,17 @@ func getConn() (*ftp.Conn, *ftp.Response, error) {
 				ImplicitTLS:     implicitTLS,
 				ServerName:      serverName,
 			},
-			DefaultMode: ftpDefaultMode,
-			LocalIP:     localIPParsed,
-			LocalPort:   localPortParsed,
-			Username:    username,
-			Password:    password,
+			DefaultMode:     ftpDefaultMode,
+			LocalIP:         localIPParsed,
+			LocalPort:       localPort,
+			Username:        username,
+			Password:        password,
+			KeepAlive:       keepAlive,
+			DialTimeout:     dialTimeout,
+			CommandTimeout:  commandTimeout,
+			DataConnTimeout: dataTimeout,
+			StallTimeout:    stallTimeout,
+			RateLimit:       rateLimiter,
 		})
 }
 
@@ -68,7 +81,7 @@ func main() {
 	// always set to true unless we are in non interactive mode
 	exitOnError := false
 
-	quitChan := make(chan os.Signal)
+	quitChan := make(chan os.Signal, 1)
 	signal.Notify(quitChan, syscall.SIGINT, syscall.SIGSTOP, syscall.SIGKILL, syscall.SIGSTKFLT)
 
 	if showCiphers {
@@ -79,6 +92,10 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flag.NArg() > 0 && flag.Arg(0) == "sync" {
+		os.Exit(runSync(flag.Args()[1:]))
+	}
+
 	// if len(parsedCommands) > 0 {
 	// 	interactiveMode = false
 	// 	for _, v := range parsedCommands {
@@ -250,7 +267,7 @@ func main() {
 					onError(conn, shell, exitOnError)
 				} else {
 					for _, dir := range dirs.([]string) {
-						shell.print(dir)
+						shell.print(dir + "\n")
 					}
 				}
 
@@ -410,9 +427,9 @@ func main() {
 				}
 			}
 
-			// finally, if command was a cd we run a pwd so we can
+			// finally, if command changed the directory we run a pwd so we can
 			// know where we are.
-			if cmd.cmd == cd && alwaysPwd {
+			if (cmd.cmd == cd || cmd.cmd == cdup || cmd.cmd == smnt || cmd.cmd == reinit) && alwaysPwd {
 				currentDir, err := commandPwd.apply(conn, true)
 				if err != nil {
 					// do nothing, it's a command that hasn't been required by the user.
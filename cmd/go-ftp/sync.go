@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nbena/ftp"
+	"github.com/nbena/ftp/ftpsync"
+)
+
+const syncUsage = "usage: go-ftp [flags] sync [sync-flags] <local-dir> <remote-dir>"
+
+// runSync runs the sync subcommand, `args` are the arguments
+// after "sync". It returns the exit code.
+func runSync(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	deleteExtra := flags.Bool("delete", false, "delete the files that are not in the source")
+	dryRun := flags.Bool("dry-run", false, "print the plan without executing it")
+	jsonOutput := flags.Bool("json", false, "print the plan as JSON")
+	download := flags.Bool("download", false, "make the local directory equal to the remote one")
+	concurrency := flags.Int("concurrency", 4, "the number of parallel transfers")
+	journal := flags.String("journal", "", "file used to resume an interrupted sync")
+	exclude := flags.String("exclude", "", "comma-separated patterns of the files to ignore")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, syncUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	conn, _, err := getConn()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	defer conn.Quit()
+
+	opts := &ftpsync.Options{
+		Mode:        ftpDefaultMode,
+		Delete:      *deleteExtra,
+		Concurrency: *concurrency,
+		Dial: func() (*ftp.Conn, error) {
+			// the local port is taken by the first connection.
+			c, _, err := getConnFromPort(0)
+			return c, err
+		},
+		Journal: *journal,
+	}
+	if *download {
+		opts.Direction = ftpsync.Download
+	}
+	if *exclude != "" {
+		opts.Exclude = strings.Split(*exclude, ",")
+	}
+
+	ctx := context.Background()
+	plan, err := ftpsync.NewPlan(ctx, conn, flags.Arg(0), flags.Arg(1), opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(plan)
+	} else {
+		for _, op := range plan.Ops {
+			fmt.Println(op.String())
+		}
+		fmt.Printf("%d operations, %d bytes to transfer\n", len(plan.Ops), plan.Bytes())
+	}
+	if *dryRun {
+		return 0
+	}
+
+	if err = ftpsync.Execute(ctx, conn, plan, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
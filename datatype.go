@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errResumeASCII is returned when resuming a transfer with TypeASCII,
+// since the offsets of the local and the remote file differ.
+var errResumeASCII = errors.New("resuming a transfer is not supported by TypeASCII")
+
+// TransferType is the representation type used to transfer
+// the files, see https://tools.ietf.org/html/rfc959#section-3.1.1.
+type TransferType string
+
+const (
+	// TypeBinary transfers the files as they are, it's the default.
+	TypeBinary = TransferType("I")
+	// TypeASCII transfers text files: the lines end with CRLF
+	// over the network and with LF locally, the conversion
+	// is made by the client.
+	TypeASCII = TransferType("A")
+)
+
+// SetType sends TYPE and sets the type of the next transfers,
+// unless they override it with TransferOptions.Type.
+// After the login, TypeBinary is always used.
+// Resuming and restarting transfers is not supported by TypeASCII.
+func (f *Conn) SetType(dataType TransferType) (*Response, error) {
+	var response *Response
+	err := f.withContext(context.Background(), func() (err error) {
+		response, err = f.setType(dataType)
+		if err == nil {
+			f.dataType = dataType
+		}
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) setType(dataType TransferType) (*Response, error) {
+	if dataType != TypeBinary && dataType != TypeASCII {
+		return nil, fmt.Errorf("invalid transfer type: %q", dataType)
+	}
+	response, err := f.writeCommandAndGetResponse("TYPE " + string(dataType) + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != TypeOk {
+		return nil, newProtocolError(TypeOk, response)
+	}
+	f.serverType = dataType
+	return response, nil
+}
+
+// ensureType sends TYPE unless `dataType` is already in use.
+func (f *Conn) ensureType(dataType TransferType) error {
+	if f.serverType == dataType {
+		return nil
+	}
+	_, err := f.setType(dataType)
+	return err
+}
+
+// transferType returns the type to use for `t`.
+func (f *Conn) transferType(t *transfer) TransferType {
+	if t.dataType != "" {
+		return t.dataType
+	}
+	if f.dataType != "" {
+		return f.dataType
+	}
+	return TypeBinary
+}
+
+// lineConverter converts the line endings of a stream,
+// chunk by chunk.
+type lineConverter interface {
+	// convert appends the conversion of `src` to `dst`.
+	convert(dst, src []byte) []byte
+	// flush appends to `dst` what's kept from the last chunk.
+	flush(dst []byte) []byte
+}
+
+// toLF converts CRLF to LF, for the downloads.
+type toLF struct {
+	pendingCR bool
+}
+
+func (c *toLF) convert(dst, src []byte) []byte {
+	for _, b := range src {
+		if c.pendingCR {
+			c.pendingCR = false
+			if b == '\n' {
+				dst = append(dst, '\n')
+				continue
+			}
+			dst = append(dst, '\r')
+		}
+		if b == '\r' {
+			c.pendingCR = true
+			continue
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+func (c *toLF) flush(dst []byte) []byte {
+	if c.pendingCR {
+		c.pendingCR = false
+		dst = append(dst, '\r')
+	}
+	return dst
+}
+
+// toCRLF converts the LF not preceded by CR to CRLF, for the uploads.
+type toCRLF struct {
+	lastCR bool
+}
+
+func (c *toCRLF) convert(dst, src []byte) []byte {
+	for _, b := range src {
+		if b == '\n' && !c.lastCR {
+			dst = append(dst, '\r')
+		}
+		dst = append(dst, b)
+		c.lastCR = b == '\r'
+	}
+	return dst
+}
+
+func (c *toCRLF) flush(dst []byte) []byte {
+	return dst
+}
+
+// lineReader converts what is read from r.
+type lineReader struct {
+	r         io.Reader
+	converter lineConverter
+	chunk     []byte
+	// buf is what has been converted but not returned yet.
+	buf []byte
+	out []byte
+	err error
+}
+
+func newLineReader(r io.Reader, converter lineConverter) *lineReader {
+	return &lineReader{r: r, converter: converter, chunk: make([]byte, bufferSize)}
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	for len(l.buf) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		n, err := l.r.Read(l.chunk)
+		l.out = l.converter.convert(l.out[:0], l.chunk[:n])
+		if err != nil {
+			l.out = l.converter.flush(l.out)
+			l.err = err
+		}
+		l.buf = l.out
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+// lineWriter converts what is written to w.
+type lineWriter struct {
+	w         io.Writer
+	converter lineConverter
+	out       []byte
+}
+
+func newLineWriter(w io.Writer, converter lineConverter) *lineWriter {
+	return &lineWriter{w: w, converter: converter}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.out = l.converter.convert(l.out[:0], p)
+	if _, err := l.w.Write(l.out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes what's kept from the last chunk.
+func (l *lineWriter) flush() error {
+	l.out = l.converter.flush(l.out[:0])
+	if len(l.out) == 0 {
+		return nil
+	}
+	_, err := l.w.Write(l.out)
+	return err
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nbena/ftp/listing"
+)
+
+// Entry is an item of a directory listing, see the listing package.
+type Entry = listing.Entry
+
+// EntryType is the type of a directory entry.
+type EntryType = listing.EntryType
+
+const (
+	// EntryUnknown is used when the server didn't send the type.
+	EntryUnknown = listing.EntryUnknown
+
+	// EntryFile is a regular file.
+	EntryFile = listing.EntryFile
+
+	// EntryDir is a directory.
+	EntryDir = listing.EntryDir
+
+	// EntryCurrentDir is the listed directory itself.
+	EntryCurrentDir = listing.EntryCurrentDir
+
+	// EntryParentDir is the parent of the listed directory.
+	EntryParentDir = listing.EntryParentDir
+
+	// EntryLink is a symbolic link.
+	EntryLink = listing.EntryLink
+)
+
+// MLSD lists the directory at `path` using the default mode, see MLSDContext.
+func (f *Conn) MLSD(path string) ([]Entry, error) {
+	return f.MLSDContext(context.Background(), IndMode, path)
+}
+
+// MLSDContext lists the directory at `path`, or the current directory
+// if `path` is empty, in the machine readable format of RFC 3659.
+// The current and the parent directory, if sent by the server,
+// are returned as well with type EntryCurrentDir and EntryParentDir.
+func (f *Conn) MLSDContext(ctx context.Context, mode Mode, path string) ([]Entry, error) {
+	if err := f.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer f.release()
+	if !f.supports("MLST") {
+		return nil, newFeatureNotSupportedError("MLST")
+	}
+
+	cmd := "MLSD\r\n"
+	if path != "" {
+		cmd = "MLSD " + path + "\r\n"
+	}
+	var lines []string
+	err := f.retry(ctx, func() (err error) {
+		lines, err = f.dataLines(ctx, mode, cmd)
+		return
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(lines))
+	for _, line := range lines {
+		entry, err := listing.ParseMLSx(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// MLST returns the facts of the file or directory at `path`,
+// or of the current directory if `path` is empty.
+// No data connection is needed.
+func (f *Conn) MLST(path string) (*Entry, error) {
+	var entry *Entry
+	err := f.withContext(context.Background(), func() (err error) {
+		entry, err = f.mlst(path)
+		return
+	})
+	return entry, err
+}
+
+func (f *Conn) mlst(path string) (*Entry, error) {
+	if !f.supports("MLST") {
+		return nil, newFeatureNotSupportedError("MLST")
+	}
+
+	f.ensureUTF8()
+
+	cmd := "MLST\r\n"
+	if path != "" {
+		cmd = "MLST " + path + "\r\n"
+	}
+	response, err := f.writeCommandAndGetResponse(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if response.Code != MlstOk {
+		return nil, newProtocolError(MlstOk, response)
+	}
+
+	// the facts are in the only line between the first and
+	// the last one, starting with a space.
+	if len(response.Lines) < 3 {
+		return nil, errors.New("Fail to parse MLST response")
+	}
+	return listing.ParseMLSx(strings.TrimPrefix(response.Lines[1], " "))
+}
+
+// ListEntries performs a LIST on `path`, or on the current directory
+// if `path` is empty, and parses its output with the listing package.
+// It's meant for the servers without MLSD, the formats that are
+// not recognized can be handled with listing.Register. The parser
+// of the system type of the server, see System, is tried first.
+func (f *Conn) ListEntries(ctx context.Context, mode Mode, path string) ([]Entry, error) {
+	lines, err := f.ListContext(ctx, mode, path)
+	if err != nil {
+		return nil, err
+	}
+	return listing.ParseSystemList(lines, f.systemType(ctx), time.Now())
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotFound is matched by the replies telling that the file
+	// is not available (550), e.g. it doesn't exist.
+	ErrNotFound = errors.New("file not found")
+	// ErrPermissionDenied is matched by the replies telling that the
+	// user is not logged in or allowed (530, 532), and by the ones
+	// refusing a command for security reasons (533, 534).
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrNotImplemented is matched by the replies telling that the
+	// command, or its parameter, is not implemented (502, 504).
+	ErrNotImplemented = errors.New("command not implemented")
+	// ErrServiceUnavailable is matched by the reply telling that
+	// the server is closing the control connection (421).
+	ErrServiceUnavailable = errors.New("service not available")
+	// ErrStorageFull is matched by the replies telling that there's
+	// not enough storage space (452, 552).
+	ErrStorageFull = errors.New("insufficient storage space")
+	// ErrNoTLS is returned when the server supports neither TLS nor SSL,
+	// its message is FailToTLS.
+	ErrNoTLS = errors.New(FailToTLS)
+	// ErrAlreadyTLS is returned by AuthTLS and AuthSSL when the
+	// control connection is already TLS-ed, its message is AlreadyTLS.
+	ErrAlreadyTLS = errors.New(AlreadyTLS)
+	// ErrInvalidCommand is returned by Command and CommandExpect when
+	// the command contains CR or LF, that would let it send other commands.
+	ErrInvalidCommand = errors.New("the command contains CR or LF")
+	// ErrReservedCommand is returned by Command and CommandExpect for
+	// the commands that must be sent with the methods of Conn.
+	ErrReservedCommand = errors.New("the command must be sent with the methods of Conn")
+)
+
+// replyCodes are the reply codes matched by each sentinel error.
+var replyCodes = map[error][]int{
+	ErrNotFound:           {FileActionNotTaken},
+	ErrPermissionDenied:   {NotLoggedIn, NeedAccount, ProtectionDenied, PolicyDenied},
+	ErrNotImplemented:     {NotImplemented, NotImplementedParam},
+	ErrServiceUnavailable: {ServiceNotAvailable},
+	ErrStorageFull:        {InsufficientStorage, ExceededStorage},
+}
+
+// ProtocolError is the error returned when the server replies with
+// a code other than the expected one, or with a code reporting a failure.
+// errors.Is matches it with the sentinel errors of its code, e.g.
+// ErrNotFound, and errors.As gives an *UnexpectedCodeError if
+// Expected is not 0.
+type ProtocolError struct {
+	// Command is the name of the last command sent, e.g. CWD,
+	// empty if the reply is not about a command, e.g. the greeting.
+	Command string
+	// Response is the reply of the server.
+	Response *Response
+	// Expected is the code that was expected, 0 if
+	// the code is a failure whatever the command is.
+	Expected int
+}
+
+func newProtocolError(expected int, response *Response) error {
+	return &ProtocolError{
+		Command:  response.command,
+		Response: response,
+		Expected: expected,
+	}
+}
+
+// Error returns the reply, `code: msg`, if no code was expected,
+// otherwise which code was expected and the command it was sent for.
+func (e *ProtocolError) Error() string {
+	if e.Expected == 0 {
+		return e.Response.String()
+	}
+	msg := fmt.Sprintf("unexpected code, want %d, got %s", e.Expected, e.Response.String())
+	if e.Command != "" {
+		msg = e.Command + ": " + msg
+	}
+	return msg
+}
+
+// Unwrap returns the *UnexpectedCodeError of the reply,
+// nil if no code was expected.
+func (e *ProtocolError) Unwrap() error {
+	if e.Expected == 0 {
+		return nil
+	}
+	return newUnexpectedCodeError(e.Expected, e.Response.Code)
+}
+
+// Is returns true if `target` is the sentinel error of the reply code.
+func (e *ProtocolError) Is(target error) bool {
+	for _, code := range replyCodes[target] {
+		if code == e.Response.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// Transient returns true if the reply is a transient negative
+// completion (4yz), the command may succeed if retried.
+func (e *ProtocolError) Transient() bool {
+	return e.Response.Code >= 400 && e.Response.Code < 500
+}
+
+// Permanent returns true if the reply is a permanent negative
+// completion (5yz), the command won't succeed if retried as it is.
+func (e *ProtocolError) Permanent() bool {
+	return e.Response.Code >= 500 && e.Response.Code < 600
+}
+
+// IsTransient returns true if `err` has been caused by
+// a transient negative completion reply (4yz).
+func IsTransient(err error) bool {
+	var protocolErr *ProtocolError
+	return errors.As(err, &protocolErr) && protocolErr.Transient()
+}
+
+// IsPermanent returns true if `err` has been caused by
+// a permanent negative completion reply (5yz).
+func IsPermanent(err error) bool {
+	var protocolErr *ProtocolError
+	return errors.As(err, &protocolErr) && protocolErr.Permanent()
+}
+
+// commandName returns the name of the command line `cmd`.
+func commandName(cmd string) string {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
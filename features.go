@@ -0,0 +1,278 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"strings"
+)
+
+// Features is the set of capabilities advertised by the server
+// in reply to a FEAT command, see https://tools.ietf.org/html/rfc2389.
+// Fields are filled only for well known features, any other
+// feature can be checked with Has and Params.
+type Features struct {
+	// MLSTFacts are the facts supported by MLST and MLSD, without
+	// the trailing '*' used by the server to mark the enabled ones.
+	MLSTFacts []string
+	// UTF8 is true if the server supports UTF-8 pathnames.
+	UTF8 bool
+	// EPSV and EPRT are the extended passive and active modes.
+	EPSV bool
+	EPRT bool
+	// RestStream is true if REST STREAM is supported.
+	RestStream bool
+	// Size and MDTM are the commands from RFC 3659.
+	Size bool
+	MDTM bool
+	// MFMT is the command used to set the modification time.
+	MFMT bool
+	// AuthTLS and AuthSSL are set according to the params of AUTH.
+	AuthTLS bool
+	AuthSSL bool
+	// PBSZ and PROT are used to protect data connections.
+	PBSZ bool
+	PROT bool
+	// ModeZ is true if the server supports compressed transfers.
+	ModeZ bool
+	// TVFS is true if the server has a trivial virtual file store.
+	TVFS bool
+	// HashAlgorithms are the algorithms supported by HASH,
+	// HashSelected is the one currently in use.
+	HashAlgorithms []string
+	HashSelected   string
+
+	// features maps each feature name (upper case) to its params.
+	features map[string]string
+	// available is false if the server doesn't implement FEAT.
+	available bool
+}
+
+// Available returns false if the server doesn't implement FEAT, in this
+// case no information about the server capabilities is known.
+func (f *Features) Available() bool {
+	return f.available
+}
+
+// Has returns true if the feature has been advertised by the server.
+func (f *Features) Has(feature string) bool {
+	_, ok := f.features[strings.ToUpper(feature)]
+	return ok
+}
+
+// Params returns the parameters of the given feature, as sent by the server.
+func (f *Features) Params(feature string) (string, bool) {
+	params, ok := f.features[strings.ToUpper(feature)]
+	return params, ok
+}
+
+// newFeatures builds the feature set from the reply to FEAT.
+// Each line but the first and the last one contains a feature,
+// optionally followed by its params.
+func newFeatures(response *Response) *Features {
+	features := &Features{
+		features:  make(map[string]string),
+		available: true,
+	}
+
+	if len(response.Lines) < 2 {
+		return features
+	}
+
+	for _, line := range response.Lines[1 : len(response.Lines)-1] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var name, params string
+		if ind := strings.Index(line, " "); ind == -1 {
+			name = line
+		} else {
+			name, params = line[:ind], strings.TrimSpace(line[ind+1:])
+		}
+		name = strings.ToUpper(name)
+
+		// some servers send a line for each param, e.g.
+		// AUTH TLS and AUTH SSL.
+		if old, ok := features.features[name]; ok && old != "" {
+			params = old + ";" + params
+		}
+		features.features[name] = params
+		features.setKnown(name, params)
+	}
+	return features
+}
+
+func (f *Features) setKnown(name, params string) {
+	switch name {
+	case "MLST":
+		f.MLSTFacts = nil
+		for _, fact := range splitParams(params) {
+			f.MLSTFacts = append(f.MLSTFacts, strings.TrimSuffix(fact, "*"))
+		}
+	case "UTF8":
+		f.UTF8 = true
+	case "EPSV":
+		f.EPSV = true
+	case "EPRT":
+		f.EPRT = true
+	case "REST":
+		f.RestStream = strings.Contains(strings.ToUpper(params), "STREAM")
+	case "SIZE":
+		f.Size = true
+	case "MDTM":
+		f.MDTM = true
+	case "MFMT":
+		f.MFMT = true
+	case "AUTH":
+		for _, param := range splitParams(params) {
+			switch strings.ToUpper(param) {
+			case "TLS", "TLS-C", "TLS-P":
+				f.AuthTLS = true
+			case "SSL":
+				f.AuthSSL = true
+			}
+		}
+	case "PBSZ":
+		f.PBSZ = true
+	case "PROT":
+		f.PROT = true
+	case "MODE":
+		f.ModeZ = strings.Contains(strings.ToUpper(params), "Z")
+	case "TVFS":
+		f.TVFS = true
+	case "HASH":
+		f.HashAlgorithms = nil
+		for _, algo := range splitParams(params) {
+			if strings.HasSuffix(algo, "*") {
+				algo = strings.TrimSuffix(algo, "*")
+				f.HashSelected = algo
+			}
+			f.HashAlgorithms = append(f.HashAlgorithms, algo)
+		}
+	}
+}
+
+// splitParams splits a semicolon separated list of params
+// skipping the empty ones.
+func splitParams(params string) []string {
+	var splitted []string
+	for _, param := range strings.Split(params, ";") {
+		param = strings.TrimSpace(param)
+		if param != "" {
+			splitted = append(splitted, param)
+		}
+	}
+	return splitted
+}
+
+// Features issues a FEAT command and returns the set of capabilities of
+// the server. The result is cached, so FEAT is sent only the first time,
+// or after the cache has been invalidated by a login or an AUTH.
+// If the server doesn't implement FEAT, an empty set is returned whose
+// Available method returns false.
+func (f *Conn) Features() (*Features, error) {
+	var features *Features
+	err := f.locked(func() (err error) {
+		features, err = f.getFeatures()
+		return
+	})
+	return features, err
+}
+
+func (f *Conn) getFeatures() (*Features, error) {
+	if f.features != nil {
+		return f.features, nil
+	}
+
+	if err := f.writeCommand("FEAT\r\n"); err != nil {
+		return nil, err
+	}
+	response, err := f.readResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case response.Code == FeatOk:
+		f.features = newFeatures(response)
+	case response.Code == NotImplemented || response.Code == SyntaxError:
+		f.features = &Features{features: make(map[string]string)}
+	default:
+		return nil, newProtocolError(FeatOk, response)
+	}
+	return f.features, nil
+}
+
+// Opts issues an OPTS command, used to set the options of `cmd`.
+func (f *Conn) Opts(cmd, args string) (*Response, error) {
+	var response *Response
+	err := f.locked(func() (err error) {
+		response, err = f.opts(cmd, args)
+		return
+	})
+	return response, err
+}
+
+func (f *Conn) opts(cmd, args string) (*Response, error) {
+	line := "OPTS " + cmd
+	if args != "" {
+		line += " " + args
+	}
+	response, err := f.writeCommandAndGetResponse(line + "\r\n")
+	if err != nil {
+		return nil, err
+	}
+	return unexpectedErrorOrResponse(OptsOk, response)
+}
+
+// supports returns false only when the server has advertised its
+// features and `feature` is not in the list. When FEAT is not
+// available we can't know, so the command is tried anyway.
+func (f *Conn) supports(feature string) bool {
+	features, err := f.getFeatures()
+	if err != nil || !features.Available() {
+		return true
+	}
+	return features.Has(feature)
+}
+
+// supportsRestStream is like supports, but the REST
+// feature must be advertised with the STREAM param.
+func (f *Conn) supportsRestStream() bool {
+	features, err := f.getFeatures()
+	if err != nil || !features.Available() {
+		return true
+	}
+	return features.RestStream
+}
+
+// ensureUTF8 turns UTF-8 on if the server advertises it, some servers
+// (e.g. IIS) won't send UTF-8 pathnames otherwise.
+func (f *Conn) ensureUTF8() {
+	if f.utf8 {
+		return
+	}
+	features, err := f.getFeatures()
+	if err != nil || !features.UTF8 {
+		return
+	}
+	// a failure here is not fatal, names will be
+	// sent in the server default encoding.
+	if _, err = f.opts("UTF8", "ON"); err == nil {
+		f.utf8 = true
+	}
+}
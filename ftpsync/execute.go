@@ -0,0 +1,325 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftpsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/nbena/ftp"
+)
+
+// Sync builds the plan to synchronize `localDir` and `remoteDir`
+// and executes it, the plan is returned even if the execution fails.
+func Sync(ctx context.Context, conn *ftp.Conn, localDir, remoteDir string, opts *Options) (*Plan, error) {
+	plan, err := NewPlan(ctx, conn, localDir, remoteDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return plan, Execute(ctx, conn, plan, opts)
+}
+
+// Execute executes the operations of `plan` in order, using `conn` for
+// everything but the parallel transfers. The direction is the one of
+// the plan, the Direction, Delete, Exclude and Hash options are only
+// used by NewPlan. The first error stops the execution.
+func Execute(ctx context.Context, conn *ftp.Conn, plan *Plan, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	j, err := openJournal(opts.Journal, plan)
+	if err != nil {
+		return err
+	}
+	defer j.close()
+
+	e := &executor{plan: plan, opts: opts, journal: j}
+	for i := 0; i < len(plan.Ops); {
+		if !plan.Ops[i].Action.isTransfer() {
+			if err = e.run(ctx, conn, plan.Ops[i]); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		end := i
+		for end < len(plan.Ops) && plan.Ops[end].Action.isTransfer() {
+			end++
+		}
+		if err = e.transferAll(ctx, conn, plan.Ops[i:end]); err != nil {
+			return err
+		}
+		i = end
+	}
+	return j.remove()
+}
+
+type executor struct {
+	plan    *Plan
+	opts    *Options
+	journal *journal
+}
+
+// transferAll runs the transfers `ops` in parallel, using
+// up to opts.Concurrency connections.
+func (e *executor) transferAll(ctx context.Context, conn *ftp.Conn, ops []Op) error {
+	n := e.opts.Concurrency
+	if n > len(ops) {
+		n = len(ops)
+	}
+	if n < 2 || e.opts.Dial == nil {
+		for _, op := range ops {
+			if err := e.run(ctx, conn, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	conns := []*ftp.Conn{conn}
+	defer func() {
+		for _, c := range conns[1:] {
+			c.Quit()
+		}
+	}()
+	for len(conns) < n {
+		c, err := e.opts.Dial()
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+	}
+
+	workersCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	opsChan := make(chan Op)
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *ftp.Conn) {
+			defer wg.Done()
+			for op := range opsChan {
+				if err := e.run(workersCtx, c, op); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}(c)
+	}
+
+loop:
+	for _, op := range ops {
+		select {
+		case opsChan <- op:
+		case <-workersCtx.Done():
+			break loop
+		}
+	}
+	close(opsChan)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// run executes `op`, unless the journal says it's already done.
+func (e *executor) run(ctx context.Context, conn *ftp.Conn, op Op) error {
+	if e.journal.isDone(op) {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	if e.plan.Direction == Download {
+		err = e.download(ctx, conn, op)
+	} else {
+		err = e.upload(ctx, conn, op)
+	}
+	if err != nil {
+		return err
+	}
+	return e.journal.record(op)
+}
+
+func (e *executor) upload(ctx context.Context, conn *ftp.Conn, op Op) error {
+	remotePath := path.Join(e.plan.Remote, op.Path)
+	var err error
+	switch op.Action {
+	case ActionMkdir:
+		_, err = conn.MkDirContext(ctx, remotePath)
+	case ActionRename:
+		_, err = conn.RenameContext(ctx, path.Join(e.plan.Remote, op.From), remotePath)
+	case ActionCreate, ActionUpdate:
+		err = conn.StoreContext(ctx, e.opts.Mode, e.localPath(op.Path), remotePath, nil)
+	case ActionDelete:
+		_, err = conn.DeleteFileContext(ctx, remotePath)
+	case ActionRmdir:
+		_, err = conn.DeleteDirContext(ctx, remotePath)
+	}
+	return err
+}
+
+func (e *executor) download(ctx context.Context, conn *ftp.Conn, op Op) error {
+	localPath := e.localPath(op.Path)
+	switch op.Action {
+	case ActionMkdir:
+		return os.MkdirAll(localPath, 0755)
+	case ActionRename:
+		return os.Rename(e.localPath(op.From), localPath)
+	case ActionCreate, ActionUpdate:
+		err := conn.RetrieveContext(ctx, e.opts.Mode, path.Join(e.plan.Remote, op.Path), localPath, nil)
+		if err != nil || op.ModTime == nil {
+			return err
+		}
+		// so that the next plan sees it as up to date.
+		return os.Chtimes(localPath, *op.ModTime, *op.ModTime)
+	case ActionDelete, ActionRmdir:
+		return os.Remove(localPath)
+	}
+	return nil
+}
+
+func (e *executor) localPath(rel string) string {
+	return filepath.Join(e.plan.Local, filepath.FromSlash(rel))
+}
+
+// journal records the completed operations, one JSON object per line.
+// The first line identifies the plan, so that the journal of another
+// plan is not used.
+type journal struct {
+	lock sync.Mutex
+	name string
+	file *os.File
+	done map[string]bool
+}
+
+type journalHeader struct {
+	Direction Direction `json:"direction"`
+	Local     string    `json:"local"`
+	Remote    string    `json:"remote"`
+}
+
+func openJournal(name string, plan *Plan) (*journal, error) {
+	j := &journal{name: name, done: make(map[string]bool)}
+	if name == "" {
+		return j, nil
+	}
+	header := journalHeader{Direction: plan.Direction, Local: plan.Local, Remote: plan.Remote}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	resumed, err := j.load(header)
+	if err != nil {
+		return nil, err
+	}
+	if !resumed {
+		flags |= os.O_TRUNC
+	}
+	if j.file, err = os.OpenFile(name, flags, 0644); err != nil {
+		return nil, err
+	}
+	if !resumed {
+		if err = json.NewEncoder(j.file).Encode(header); err != nil {
+			j.file.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// load reads the operations of an existing journal, it returns
+// false if there's no journal for the plan of `header`.
+func (j *journal) load(header journalHeader) (bool, error) {
+	f, err := os.Open(j.name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	var got journalHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &got) != nil || got != header {
+		return false, nil
+	}
+	for scanner.Scan() {
+		var op Op
+		// a truncated last line is ignored.
+		if json.Unmarshal(scanner.Bytes(), &op) == nil {
+			j.done[journalKey(op)] = true
+		}
+	}
+	return true, scanner.Err()
+}
+
+// journalKey identifies an operation, the size and the time of the
+// transferred files are part of it, so that a file changed since
+// the journal was written is transferred again.
+func journalKey(op Op) string {
+	key := string(op.Action) + "\x00" + op.From + "\x00" + op.Path +
+		"\x00" + strconv.FormatInt(op.Size, 10)
+	if op.ModTime != nil {
+		key += "\x00" + strconv.FormatInt(op.ModTime.UnixNano(), 10)
+	}
+	return key
+}
+
+func (j *journal) isDone(op Op) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.done[journalKey(op)]
+}
+
+func (j *journal) record(op Op) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.done[journalKey(op)] = true
+	if j.file == nil {
+		return nil
+	}
+	return json.NewEncoder(j.file).Encode(op)
+}
+
+func (j *journal) close() {
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+// remove deletes the journal of a completed plan.
+func (j *journal) remove() error {
+	if j.file == nil {
+		return nil
+	}
+	j.close()
+	return os.Remove(j.name)
+}
@@ -0,0 +1,268 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftpsync
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbena/ftp"
+)
+
+func authenticatedConn() (*ftp.Conn, error) {
+	conn, _, err := ftp.DialAndAuthenticate("localhost:2121", &ftp.Config{
+		DefaultMode: ftp.PassiveMode,
+		Username:    "anonymous",
+		Password:    "c@b.com",
+		LocalIP:     net.IP([]byte{127, 0, 0, 1}),
+	})
+	return conn, err
+}
+
+func opsString(ops []Op) string {
+	var rows []string
+	for _, op := range ops {
+		rows = append(rows, op.String())
+	}
+	return strings.Join(rows, ",")
+}
+
+func TestDiff(t *testing.T) {
+	old := time.Date(2018, 3, 12, 11, 30, 0, 0, time.UTC)
+	recent := old.Add(time.Hour)
+
+	src := tree{
+		".":           {dir: true},
+		"new":         {dir: true},
+		"new/a.txt":   {size: 1, modTime: old},
+		"same.txt":    {size: 2, modTime: old},
+		"older.txt":   {size: 2, modTime: old},
+		"newer.txt":   {size: 2, modTime: recent},
+		"size.txt":    {size: 3, modTime: old},
+		"moved/b.txt": {size: 4, modTime: old},
+		"moved/d.txt": {size: 5, modTime: old},
+		"moved":       {dir: true},
+	}
+	dst := tree{
+		".":         {dir: true},
+		"same.txt":  {size: 2, modTime: old},
+		"older.txt": {size: 2, modTime: recent},
+		"newer.txt": {size: 2, modTime: old},
+		"size.txt":  {size: 2, modTime: old},
+		"b.txt":     {size: 4, modTime: old},
+		"d.txt":     {size: 5, modTime: recent},
+		"old":       {dir: true},
+		"old/sub":   {dir: true},
+		"old/c.txt": {size: 1, modTime: old},
+	}
+
+	ops, err := diff(src, dst, false, &hasher{})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	expected := "mkdir moved,mkdir new,create moved/b.txt,create moved/d.txt,create new/a.txt," +
+		"update newer.txt (newer),update size.txt (size)"
+	if got := opsString(ops); got != expected {
+		t.Errorf("Wrong ops, expected %s, got %s", expected, got)
+	}
+
+	if ops, err = diff(src, dst, true, &hasher{}); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	// without a hash, d.txt has a different time, so it's not renamed.
+	expected = "mkdir moved,mkdir new,rename b.txt -> moved/b.txt,create moved/d.txt,create new/a.txt," +
+		"update newer.txt (newer),update size.txt (size),delete d.txt,delete old/c.txt,rmdir old/sub,rmdir old"
+	if got := opsString(ops); got != expected {
+		t.Errorf("Wrong ops, expected %s, got %s", expected, got)
+	}
+
+	dst["new"] = &file{size: 1}
+	if _, err = diff(src, dst, false, &hasher{}); err == nil {
+		t.Errorf("Expected error on a file replaced by a directory")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpsync")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "journal")
+	plan := &Plan{Direction: Upload, Local: "local", Remote: "remote"}
+	modTime := time.Date(2018, 3, 12, 11, 30, 0, 0, time.UTC)
+	op := Op{Action: ActionCreate, Path: "a.txt", Size: 1, ModTime: &modTime}
+
+	j, err := openJournal(name, plan)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = j.record(op); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	j.close()
+
+	if j, err = openJournal(name, plan); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if !j.isDone(op) || j.isDone(Op{Action: ActionCreate, Path: "b.txt"}) {
+		t.Errorf("Wrong journal: %v", j.done)
+	}
+	// the file has changed since it was transferred.
+	changed := op
+	changed.Size = 2
+	if j.isDone(changed) {
+		t.Errorf("Changed file considered done")
+	}
+	j.close()
+
+	// the journal of another plan is discarded.
+	other := &Plan{Direction: Download, Local: "local", Remote: "remote"}
+	if j, err = openJournal(name, other); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if j.isDone(op) {
+		t.Errorf("Journal of another plan used")
+	}
+	if err = j.remove(); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Journal not removed: %v", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	conn, err := authenticatedConn()
+	if err != nil {
+		t.Fatalf("Conn error: %s", err.Error())
+	}
+	defer conn.Quit()
+
+	localDir, err := ioutil.TempDir("", "ftpsync")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	defer os.RemoveAll(localDir)
+
+	modTime := time.Now().Add(-time.Hour)
+	files := []string{"a.txt", "sub/b.txt", "sub/c.txt", "sub/deep/d.txt"}
+	for _, name := range files {
+		localPath := filepath.Join(localDir, "src", filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+		if err = ioutil.WriteFile(localPath, []byte(name), 0644); err != nil {
+			t.Fatalf("Got error: %s", err.Error())
+		}
+		os.Chtimes(localPath, modTime, modTime)
+	}
+	defer func() {
+		for _, name := range []string{"sync/a.txt", "sync/sub/b.txt", "sync/sub/deep/d.txt", "sync/sub/e.txt"} {
+			conn.DeleteFile(name)
+		}
+		for _, name := range []string{"sync/sub/deep", "sync/sub", "sync"} {
+			conn.DeleteDir(name)
+		}
+	}()
+
+	ctx := context.Background()
+	src := filepath.Join(localDir, "src")
+	opts := &Options{
+		Delete:      true,
+		Concurrency: 3,
+		Dial:        authenticatedConn,
+		Journal:     filepath.Join(localDir, "journal"),
+	}
+
+	plan, err := Sync(ctx, conn, src, "sync", opts)
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	expected := "mkdir .,mkdir sub,mkdir sub/deep,create a.txt,create sub/b.txt,create sub/c.txt,create sub/deep/d.txt"
+	if got := opsString(plan.Ops); got != expected {
+		t.Errorf("Wrong plan, expected %s, got %s", expected, got)
+	}
+	if _, err = os.Stat(opts.Journal); !os.IsNotExist(err) {
+		t.Errorf("Journal not removed: %v", err)
+	}
+
+	if plan, err = NewPlan(ctx, conn, src, "sync", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(plan.Ops) != 0 {
+		t.Errorf("Expected empty plan, got %s", opsString(plan.Ops))
+	}
+
+	// renaming c.txt and changing a.txt.
+	if err = os.Rename(filepath.Join(src, "sub", "c.txt"), filepath.Join(src, "sub", "e.txt")); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if err = ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	opts.Hash = func(conn *ftp.Conn, remotePath string) (string, string, error) {
+		localPath := filepath.Join(src, strings.TrimPrefix(remotePath, "sync/"))
+		if _, err := os.Stat(localPath); err != nil {
+			// the renamed file.
+			localPath = filepath.Join(src, "sub", "e.txt")
+		}
+		sum, err := ftp.HashFile(localPath, ftp.HashSHA256)
+		return "SHA-256", sum, err
+	}
+	if plan, err = Sync(ctx, conn, src, "sync", opts); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	expected = "rename sub/c.txt -> sub/e.txt,update a.txt (size)"
+	if got := opsString(plan.Ops); got != expected {
+		t.Errorf("Wrong plan, expected %s, got %s", expected, got)
+	}
+
+	dst := filepath.Join(localDir, "dst")
+	if plan, err = Sync(ctx, conn, dst, "sync", &Options{Direction: Download}); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if string(content) != "changed" {
+		t.Errorf("Wrong content: %s", content)
+	}
+	if plan, err = NewPlan(ctx, conn, dst, "sync", &Options{Direction: Download}); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(plan.Ops) != 0 {
+		t.Errorf("Expected empty plan, got %s", opsString(plan.Ops))
+	}
+
+	encoded, err := json.Marshal(&Plan{Direction: Download, Ops: []Op{{Action: ActionMkdir, Path: "."}}})
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if string(encoded) != `{"direction":"download","local":"","remote":"","ops":[{"action":"mkdir","path":"."}]}` {
+		t.Errorf("Wrong JSON: %s", encoded)
+	}
+}
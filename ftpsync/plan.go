@@ -0,0 +1,495 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ftpsync synchronizes a local and a remote directory tree in
+// one direction, like rsync does. The trees are compared to build a
+// Plan of the operations needed to make the destination equal to the
+// source, the plan can be inspected, printed as JSON, and executed
+// with parallel transfers and a journal that allows to resume it.
+package ftpsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbena/ftp"
+)
+
+// Direction is the direction of a synchronization.
+type Direction int
+
+const (
+	// Upload makes the remote tree equal to the local one.
+	Upload = Direction(0)
+
+	// Download makes the local tree equal to the remote one.
+	Download = Direction(1)
+)
+
+func (d Direction) String() string {
+	if d == Download {
+		return "download"
+	}
+	return "upload"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Direction) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "upload":
+		*d = Upload
+	case "download":
+		*d = Download
+	default:
+		return fmt.Errorf("Fail to parse direction: %s", text)
+	}
+	return nil
+}
+
+// Action is the kind of an operation of a plan.
+type Action string
+
+const (
+	// ActionMkdir creates a directory.
+	ActionMkdir = Action("mkdir")
+
+	// ActionRename moves a file of the destination from `From`
+	// to `Path`, instead of deleting and transferring it again.
+	ActionRename = Action("rename")
+
+	// ActionCreate transfers a file missing in the destination.
+	ActionCreate = Action("create")
+
+	// ActionUpdate transfers a file that differs in the destination.
+	ActionUpdate = Action("update")
+
+	// ActionDelete removes a file not in the source.
+	ActionDelete = Action("delete")
+
+	// ActionRmdir removes a directory not in the source.
+	ActionRmdir = Action("rmdir")
+)
+
+// isTransfer returns true if the action transfers a file.
+func (a Action) isTransfer() bool {
+	return a == ActionCreate || a == ActionUpdate
+}
+
+// Op is an operation of a plan, the paths are slash-separated
+// and relative to the roots.
+type Op struct {
+	Action Action `json:"action"`
+	Path   string `json:"path"`
+	// From is the old path of a renamed file.
+	From string `json:"from,omitempty"`
+	// Size is the size of the transferred file.
+	Size int64 `json:"size,omitempty"`
+	// ModTime is the modification time of the transferred file in
+	// the source, it's given to the downloaded files.
+	ModTime *time.Time `json:"mtime,omitempty"`
+	// Reason tells why a file is updated: "size", "newer" or "hash".
+	Reason string `json:"reason,omitempty"`
+}
+
+func (op Op) String() string {
+	if op.Action == ActionRename {
+		return fmt.Sprintf("%s %s -> %s", op.Action, op.From, op.Path)
+	}
+	if op.Reason != "" {
+		return fmt.Sprintf("%s %s (%s)", op.Action, op.Path, op.Reason)
+	}
+	return fmt.Sprintf("%s %s", op.Action, op.Path)
+}
+
+// Plan is the list of the operations that make the destination equal
+// to the source. The operations are in execution order: directories
+// are created first, then files are renamed, transferred and deleted,
+// and finally the directories are removed, the deepest first.
+type Plan struct {
+	Direction Direction `json:"direction"`
+	Local     string    `json:"local"`
+	Remote    string    `json:"remote"`
+	Ops       []Op      `json:"ops"`
+}
+
+// Bytes returns the total size of the files to transfer.
+func (p *Plan) Bytes() int64 {
+	var bytes int64
+	for _, op := range p.Ops {
+		if op.Action.isTransfer() {
+			bytes += op.Size
+		}
+	}
+	return bytes
+}
+
+// HashFunc returns the checksum of a remote file as a hex string, and
+// the name of the algorithm used, one of "MD5", "SHA-1", "SHA-256",
+// "SHA-512" and "CRC32".
+type HashFunc func(conn *ftp.Conn, remotePath string) (algorithm, sum string, err error)
+
+// Options are the optional params of NewPlan and Execute.
+// A nil *Options means the defaults.
+type Options struct {
+	// Direction is the direction of the synchronization.
+	Direction Direction
+	// Mode is the mode used for the data connections,
+	// ftp.IndMode means the default one.
+	Mode ftp.Mode
+	// Delete removes from the destination the files and the directories
+	// that are not in the source, and it enables the detection of the
+	// renamed files.
+	Delete bool
+	// Exclude are the patterns of the files and directories to ignore
+	// on both sides, they use the path.Match syntax and they are
+	// matched against both the relative path and the name.
+	Exclude []string
+	// Hash, if set, is used when a file has the same size but the source
+	// is newer: if the checksums are equal the file is not transferred.
+	// It's also used to detect the renamed files.
+	Hash HashFunc
+	// Concurrency is the number of parallel transfers, values lower
+	// than 2 mean that only the given connection is used.
+	Concurrency int
+	// Dial opens the additional connections used for the parallel
+	// transfers, without it Concurrency is ignored.
+	Dial func() (*ftp.Conn, error)
+	// Journal is the path of a local file where the completed operations
+	// are recorded. If the execution of a plan fails, executing it again
+	// with the same journal skips what has already been done. The journal
+	// is removed when the plan is completed.
+	Journal string
+}
+
+// file is a file or a directory of a tree.
+type file struct {
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// tree are the items of a tree by relative path, the root is ".".
+type tree map[string]*file
+
+// NewPlan compares the local directory `localDir` and the remote
+// directory `remoteDir` and returns the operations needed to synchronize
+// them. A file is transferred if it's missing in the destination, if the
+// sizes differ, or if the one in the source is newer. The modification
+// times of the remote files are taken from MLSD, or from MDTM when MLSD
+// is not supported. Links and special files are ignored.
+func NewPlan(ctx context.Context, conn *ftp.Conn, localDir, remoteDir string, opts *Options) (*Plan, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	local, err := scanLocal(localDir, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := scanRemote(ctx, conn, remoteDir, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	src, dst := local, remote
+	if opts.Direction == Download {
+		src, dst = remote, local
+	}
+	if src["."] == nil {
+		return nil, errors.New("Fail to sync: the source directory doesn't exist")
+	}
+
+	h := &hasher{
+		conn:      conn,
+		localDir:  localDir,
+		remoteDir: remoteDir,
+		hash:      opts.Hash,
+		direction: opts.Direction,
+	}
+	ops, err := diff(src, dst, opts.Delete, h)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Direction: opts.Direction,
+		Local:     localDir,
+		Remote:    remoteDir,
+		Ops:       ops,
+	}, nil
+}
+
+func scanLocal(localDir string, exclude []string) (tree, error) {
+	items := make(tree)
+	err := filepath.Walk(localDir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if localPath == localDir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && ftp.MatchAny(exclude, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			items[rel] = &file{dir: true}
+		} else if info.Mode().IsRegular() {
+			items[rel] = &file{size: info.Size(), modTime: info.ModTime()}
+		}
+		return nil
+	})
+	return items, err
+}
+
+func scanRemote(ctx context.Context, conn *ftp.Conn, remoteDir string, opts *Options) (tree, error) {
+	features, err := conn.Features()
+	hasMLST := err == nil && features.Has("MLST")
+
+	items := make(tree)
+	root := path.Clean(remoteDir)
+	err = conn.WalkContext(ctx, remoteDir, func(remotePath string, entry *ftp.Entry, err error) error {
+		rel := ftp.RelativePath(root, remotePath)
+		if err != nil {
+			if rel == "." {
+				// the root doesn't exist, or it can't be read:
+				// in the latter case the execution will fail.
+				delete(items, rel)
+				return ftp.SkipDir
+			}
+			return err
+		}
+		if rel != "." && ftp.MatchAny(opts.Exclude, rel) {
+			return ftp.SkipDir
+		}
+
+		if entry.Type.IsDir() {
+			items[rel] = &file{dir: true}
+			return nil
+		}
+		if entry.Type != ftp.EntryFile {
+			return nil
+		}
+		modTime := entry.ModTime
+		if !hasMLST {
+			// the times of LIST have no seconds.
+			if _, mdtm, err := conn.LastModificationTime(remotePath); err == nil {
+				modTime = *mdtm
+			}
+		}
+		items[rel] = &file{size: entry.Size, modTime: modTime}
+		return nil
+	}, &ftp.WalkOptions{Mode: opts.Mode})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// diff returns the operations that make `dst` equal to `src`.
+func diff(src, dst tree, deleteExtra bool, h *hasher) ([]Op, error) {
+	var mkdirs, transfers, deletes, rmdirs, renames []Op
+
+	for _, rel := range sortedPaths(src) {
+		s, d := src[rel], dst[rel]
+		if d != nil && s.dir != d.dir {
+			return nil, fmt.Errorf("Fail to sync %s: it's a file on one side and a directory on the other", rel)
+		}
+		if s.dir {
+			if d == nil {
+				mkdirs = append(mkdirs, Op{Action: ActionMkdir, Path: rel})
+			}
+			continue
+		}
+
+		op := Op{Action: ActionCreate, Path: rel, Size: s.size, ModTime: timePtr(s.modTime)}
+		if d != nil {
+			reason, err := h.changed(rel, s, d)
+			if err != nil {
+				return nil, err
+			}
+			if reason == "" {
+				continue
+			}
+			op.Action, op.Reason = ActionUpdate, reason
+		}
+		transfers = append(transfers, op)
+	}
+
+	if deleteExtra {
+		for _, rel := range sortedPaths(dst) {
+			if src[rel] != nil {
+				continue
+			}
+			if dst[rel].dir {
+				rmdirs = append(rmdirs, Op{Action: ActionRmdir, Path: rel})
+			} else {
+				deletes = append(deletes, Op{Action: ActionDelete, Path: rel})
+			}
+		}
+		var err error
+		if renames, transfers, deletes, err = h.detectRenames(dst, transfers, deletes); err != nil {
+			return nil, err
+		}
+		// the deepest first.
+		sort.Slice(rmdirs, func(i, j int) bool {
+			return rmdirs[i].Path > rmdirs[j].Path
+		})
+	}
+
+	ops := make([]Op, 0, len(mkdirs)+len(renames)+len(transfers)+len(deletes)+len(rmdirs))
+	for _, group := range [][]Op{mkdirs, renames, transfers, deletes, rmdirs} {
+		ops = append(ops, group...)
+	}
+	return ops, nil
+}
+
+// hasher compares the files using the checksums, if available.
+type hasher struct {
+	conn      *ftp.Conn
+	localDir  string
+	remoteDir string
+	hash      HashFunc
+	// direction is used to know where the source is.
+	direction Direction
+}
+
+// changed returns why the destination `d` of `rel` must be updated,
+// or an empty string if it's up to date.
+func (h *hasher) changed(rel string, s, d *file) (string, error) {
+	if s.size != d.size {
+		return "size", nil
+	}
+	if !s.modTime.Truncate(time.Second).After(d.modTime.Truncate(time.Second)) {
+		return "", nil
+	}
+	if h.hash == nil {
+		return "newer", nil
+	}
+	same, err := h.sameContent(rel, rel)
+	if err != nil || same {
+		return "", err
+	}
+	return "hash", nil
+}
+
+// detectRenames pairs the files to delete with the files to create
+// having the same size and, when available, the same checksum,
+// otherwise the same name and modification time.
+// Only unambiguous pairs are considered.
+func (h *hasher) detectRenames(dst tree, transfers, deletes []Op) ([]Op, []Op, []Op, error) {
+	var renames, keptTransfers []Op
+	renamed := make(map[string]bool)
+
+	for _, op := range transfers {
+		if op.Action != ActionCreate {
+			keptTransfers = append(keptTransfers, op)
+			continue
+		}
+		var candidates []string
+		for _, del := range deletes {
+			if renamed[del.Path] || dst[del.Path].size != op.Size {
+				continue
+			}
+			if h.hash == nil && (path.Base(del.Path) != path.Base(op.Path) ||
+				op.ModTime == nil || !sameTime(*op.ModTime, dst[del.Path].modTime)) {
+				continue
+			}
+			candidates = append(candidates, del.Path)
+		}
+		if len(candidates) == 1 && h.hash != nil {
+			same, err := h.sameContent(op.Path, candidates[0])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if !same {
+				candidates = nil
+			}
+		}
+		if len(candidates) != 1 {
+			keptTransfers = append(keptTransfers, op)
+			continue
+		}
+		renamed[candidates[0]] = true
+		renames = append(renames, Op{Action: ActionRename, Path: op.Path, From: candidates[0]})
+	}
+
+	var keptDeletes []Op
+	for _, del := range deletes {
+		if !renamed[del.Path] {
+			keptDeletes = append(keptDeletes, del)
+		}
+	}
+	return renames, keptTransfers, keptDeletes, nil
+}
+
+// sameContent returns true if the source file `srcRel` and
+// the destination file `dstRel` have the same checksum.
+func (h *hasher) sameContent(srcRel, dstRel string) (bool, error) {
+	localRel, remoteRel := srcRel, dstRel
+	if h.direction == Download {
+		localRel, remoteRel = dstRel, srcRel
+	}
+	algorithm, remoteSum, err := h.hash(h.conn, path.Join(h.remoteDir, remoteRel))
+	if err != nil {
+		return false, err
+	}
+	localSum, err := ftp.HashFile(filepath.Join(h.localDir, filepath.FromSlash(localRel)),
+		ftp.HashAlgorithm(strings.ToUpper(algorithm)))
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(localSum, remoteSum), nil
+}
+
+func sortedPaths(items tree) []string {
+	paths := make([]string, 0, len(items))
+	for rel := range items {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// sameTime compares the modification times with second precision,
+// as the remote ones may have no fractional part.
+func sameTime(t1, t2 time.Time) bool {
+	return t1.Truncate(time.Second).Equal(t2.Truncate(time.Second))
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
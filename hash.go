@@ -0,0 +1,269 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HashAlgorithm is an algorithm used by the server to hash a file,
+// named as in https://tools.ietf.org/html/draft-bryan-ftpext-hash-02.
+type HashAlgorithm string
+
+const (
+	// HashCRC32 is the IEEE CRC-32, the legacy command is XCRC.
+	HashCRC32 = HashAlgorithm("CRC32")
+	// HashMD5 is MD5, the legacy command is XMD5.
+	HashMD5 = HashAlgorithm("MD5")
+	// HashSHA1 is SHA-1, the legacy command is XSHA1.
+	HashSHA1 = HashAlgorithm("SHA-1")
+	// HashSHA256 is SHA-256, the legacy command is XSHA256.
+	HashSHA256 = HashAlgorithm("SHA-256")
+	// HashSHA512 is SHA-512, the legacy command is XSHA512.
+	HashSHA512 = HashAlgorithm("SHA-512")
+)
+
+// legacyHashCommands are the commands that have been used
+// to hash a file before HASH.
+var legacyHashCommands = map[HashAlgorithm]string{
+	HashCRC32:  "XCRC",
+	HashMD5:    "XMD5",
+	HashSHA1:   "XSHA1",
+	HashSHA256: "XSHA256",
+	HashSHA512: "XSHA512",
+}
+
+// newHash returns the local implementation of `algo`.
+func newHash(algo HashAlgorithm) (hash.Hash, error) {
+	switch algo {
+	case HashCRC32:
+		return crc32.NewIEEE(), nil
+	case HashMD5:
+		return md5.New(), nil
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm: %q", algo)
+}
+
+// HashFile returns the hash of the local file `name` computed using
+// `algo`, hex-encoded in lower case as the one returned by Hash.
+func HashFile(name string, algo HashAlgorithm) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ChecksumMismatchError is the error returned when the hash of the
+// bytes transferred differs from the one computed by the server,
+// see TransferOptions.VerifyChecksum.
+type ChecksumMismatchError struct {
+	Path      string
+	Algorithm HashAlgorithm
+	// Local and Remote are the hex-encoded hashes.
+	Local  string
+	Remote string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s: local %s, remote %s",
+		e.Algorithm,
+		e.Path,
+		e.Local,
+		e.Remote)
+}
+
+// Hash returns the hash of the remote file `path` computed by the
+// server using `algo`, hex-encoded in lower case.
+// HASH is used if the server advertises `algo` for it, selecting it
+// with OPTS HASH if needed, otherwise the legacy commands
+// (XCRC, XMD5, XSHA1, XSHA256 and XSHA512) are tried.
+func (f *Conn) Hash(path string, algo HashAlgorithm) (string, error) {
+	return f.HashRange(path, algo, 0, -1)
+}
+
+// HashRange is like Hash, but only the bytes from `start` to `end`,
+// excluded, are hashed; an `end` < 0 means the end of the file.
+// Ranges are sent with RANG, so HASH is required.
+func (f *Conn) HashRange(path string, algo HashAlgorithm, start, end int64) (string, error) {
+	var sum string
+	err := f.withContext(context.Background(), func() (err error) {
+		sum, err = f.hash(path, algo, start, end)
+		return
+	})
+	return sum, err
+}
+
+func (f *Conn) hash(path string, algo HashAlgorithm, start, end int64) (string, error) {
+	local, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	ranged := start > 0 || end >= 0
+	if ranged && end >= 0 && end <= start {
+		return "", fmt.Errorf("invalid range: %d-%d", start, end)
+	}
+
+	features, err := f.getFeatures()
+	if err != nil || !features.Has("HASH") || !hasAlgorithm(features, algo) {
+		if ranged {
+			return "", newFeatureNotSupportedError("HASH")
+		}
+		return f.legacyHash(path, algo, local.Size())
+	}
+
+	if features.HashSelected != string(algo) {
+		if _, err = f.opts("HASH", string(algo)); err != nil {
+			return "", err
+		}
+		features.HashSelected = string(algo)
+	}
+	if ranged {
+		if !f.supports("RANG") {
+			return "", newFeatureNotSupportedError("RANG")
+		}
+		if end < 0 {
+			_, size, err := f.size(path)
+			if err != nil {
+				return "", err
+			}
+			end = int64(size)
+		}
+		// RANG takes the last byte, not the one after it.
+		response, err := f.writeCommandAndGetResponse("RANG " + strconv.FormatInt(start, 10) + " " + strconv.FormatInt(end-1, 10) + "\r\n")
+		if err != nil {
+			return "", err
+		}
+		if response.Code != RangOk {
+			return "", newProtocolError(RangOk, response)
+		}
+	}
+
+	response, err := f.writeCommandAndGetResponse("HASH " + path + "\r\n")
+	if err != nil {
+		return "", err
+	}
+	if response.Code != HashOk {
+		return "", newProtocolError(HashOk, response)
+	}
+	// <algorithm> <start>-<end> <hash> <path>
+	fields := strings.Fields(response.Msg)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("Fail to parse hash: %s", response.Msg)
+	}
+	return parseHash(fields[2:3], local.Size())
+}
+
+// hasAlgorithm returns true if `algo` is advertised for HASH.
+func hasAlgorithm(features *Features, algo HashAlgorithm) bool {
+	for _, advertised := range features.HashAlgorithms {
+		if strings.EqualFold(advertised, string(algo)) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyHash hashes `path` with the X command of `algo`.
+// The replies differ between the servers, so the hash is
+// the first word of the reply that looks like a hash.
+func (f *Conn) legacyHash(path string, algo HashAlgorithm, size int) (string, error) {
+	response, err := f.writeCommandAndGetResponse(legacyHashCommands[algo] + " " + path + "\r\n")
+	if err != nil {
+		return "", err
+	}
+	if response.Code != LegacyHashOk && response.Code != HashOk {
+		return "", newProtocolError(LegacyHashOk, response)
+	}
+	return parseHash(strings.Fields(response.Msg), size)
+}
+
+// parseHash returns the first of `words` that is a hex-encoded hash
+// of `size` bytes. Some servers strip the leading zeros of CRC-32.
+func parseHash(words []string, size int) (string, error) {
+	for _, word := range words {
+		word = strings.ToLower(word)
+		if len(word) > size*2 || len(word) < size*2 && size != crc32.Size {
+			continue
+		}
+		if _, err := hex.DecodeString(strings.Repeat("0", len(word)%2) + word); err != nil {
+			continue
+		}
+		return strings.Repeat("0", size*2-len(word)) + word, nil
+	}
+	return "", fmt.Errorf("Fail to parse hash: %s", strings.Join(words, " "))
+}
+
+// verifyChecksum compares the checksum of the bytes of `t` with the
+// one of the same bytes of the remote file `path`, starting at `start`.
+// `localPath`, if not empty, is a local file equal to the whole remote
+// one: if the server can't hash a range, e.g. it has HASH but not RANG,
+// the two whole files are compared instead.
+func (f *Conn) verifyChecksum(path string, t *transfer, start int64, localPath string) error {
+	local := hex.EncodeToString(t.checksum.Sum(nil))
+	end := int64(-1)
+	if start > 0 {
+		end = start + t.transferred
+	}
+	remote, err := f.hash(path, t.verifyChecksum, start, end)
+	var featureErr *FeatureNotSupportedError
+	if start > 0 && localPath != "" && errors.As(err, &featureErr) {
+		if local, err = HashFile(localPath, t.verifyChecksum); err != nil {
+			return err
+		}
+		remote, err = f.hash(path, t.verifyChecksum, 0, -1)
+	}
+	if err != nil {
+		return err
+	}
+	if remote != local {
+		return &ChecksumMismatchError{
+			Path:      path,
+			Algorithm: t.verifyChecksum,
+			Local:     local,
+			Remote:    remote,
+		}
+	}
+	return nil
+}
@@ -24,7 +24,18 @@ import (
 )
 
 func portString(ip net.IP, n1, n2 int) string {
-	return strings.Replace(ip.String(), ".", ",", 4) + "," + strconv.Itoa(n1) + "," + strconv.Itoa(n2)
+	return strings.Replace(ip.To4().String(), ".", ",", 4) + "," + strconv.Itoa(n1) + "," + strconv.Itoa(n2)
+}
+
+// eprtString returns the argument of EPRT, in the form
+// `|<proto>|<ip>|<port>|`, where proto is 1 for IPv4 and 2 for IPv6.
+func eprtString(ip net.IP, port int) string {
+	proto := "2"
+	if ip.To4() != nil {
+		proto = "1"
+		ip = ip.To4()
+	}
+	return "|" + proto + "|" + ip.String() + "|" + strconv.Itoa(port) + "|"
 }
 
 // func portNumbers(port int) (int, int) {
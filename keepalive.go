@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"time"
+)
+
+// noopDrainTimeout is how long the replies to the NOOPs sent during
+// a transfer are waited for once it's complete, since some servers
+// send them only at the end and others never send them.
+const noopDrainTimeout = time.Second
+
+// keepAlive sends the NOOPs while the connection is idle and closes
+// it once it has been idle for too long, see Config.KeepAlive and
+// Config.IdleTimeout. It returns when the connection is closed.
+func (f *Conn) keepAlive() {
+	interval, idleTimeout := f.config.KeepAlive, f.config.IdleTimeout
+	tick := interval
+	if tick <= 0 || idleTimeout > 0 && idleTimeout < tick {
+		tick = idleTimeout
+	}
+	// checking often enough to be on time.
+	if tick > 1 {
+		tick /= 2
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var lastNoop time.Time
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !f.tryAcquire() {
+			// in use, transfers send their own NOOPs.
+			continue
+		}
+
+		idle := time.Since(f.lastUsed)
+		if idleTimeout > 0 && idle >= idleTimeout {
+			f.cancel()
+			if _, err := f.quit(); err != nil {
+				f.control.Close()
+			}
+			<-f.lock.channel()
+			return
+		}
+		if interval > 0 && idle >= interval && time.Since(lastNoop) >= interval {
+			// if it fails, the next command fails as well.
+			f.noop()
+			lastNoop = time.Now()
+		}
+		// not a use of the connection, lastUsed is left as it is.
+		<-f.lock.channel()
+	}
+}
+
+// keepAliveTransfer sends a NOOP every KeepAlive interval while a transfer
+// is running, since meanwhile the control connection is idle. The returned
+// function stops it, it must be called before reading the replies of the
+// transfer, that are read with transferResponse.
+func (f *Conn) keepAliveTransfer() func() {
+	interval := f.config.KeepAlive
+	if interval <= 0 {
+		return func() {}
+	}
+
+	stopChan := make(chan struct{})
+	stoppedChan := make(chan struct{})
+	go func() {
+		defer close(stoppedChan)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+			}
+			// not recorded as the last command, the final
+			// reply is still about the transfer.
+			if f.writeLine("NOOP\r\n") != nil {
+				return
+			}
+			f.pendingNoops++
+		}
+	}()
+
+	stopped := false
+	return func() {
+		if !stopped {
+			stopped = true
+			close(stopChan)
+			<-stoppedChan
+		}
+	}
+}
+
+// transferResponse reads the next reply about the running transfer,
+// skipping the replies to the NOOPs sent by keepAliveTransfer.
+func (f *Conn) transferResponse() (*Response, error) {
+	for {
+		response, err := f.getFtpResponse()
+		if err != nil || f.pendingNoops == 0 || response.Code != NoopOk {
+			return response, err
+		}
+		f.pendingNoops--
+	}
+}
+
+// drainNoops reads the replies to the NOOPs sent during
+// a transfer that are still pending once it's complete.
+func (f *Conn) drainNoops() {
+	if f.pendingNoops == 0 {
+		return
+	}
+	f.control.SetReadDeadline(time.Now().Add(noopDrainTimeout))
+	for ; f.pendingNoops > 0; f.pendingNoops-- {
+		if _, err := f.readResponse(); err != nil {
+			break
+		}
+	}
+	f.control.SetReadDeadline(time.Time{})
+	f.pendingNoops = 0
+}
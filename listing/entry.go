@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package listing parses the directory listings sent by FTP servers:
+// the machine readable MLSx format of RFC 3659, and the output of LIST
+// in the most common formats (Unix `ls -l`, DOS/IIS and EPLF).
+package listing
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// EntryType is the type of a directory entry.
+type EntryType int
+
+const (
+	// EntryUnknown is used when the server didn't send the type.
+	EntryUnknown = EntryType(0)
+
+	// EntryFile is a regular file.
+	EntryFile = EntryType(1)
+
+	// EntryDir is a directory.
+	EntryDir = EntryType(2)
+
+	// EntryCurrentDir is the listed directory itself.
+	EntryCurrentDir = EntryType(3)
+
+	// EntryParentDir is the parent of the listed directory.
+	EntryParentDir = EntryType(4)
+
+	// EntryLink is a symbolic link.
+	EntryLink = EntryType(5)
+)
+
+func (t EntryType) String() string {
+	switch t {
+	case EntryFile:
+		return "file"
+	case EntryDir:
+		return "dir"
+	case EntryCurrentDir:
+		return "cdir"
+	case EntryParentDir:
+		return "pdir"
+	case EntryLink:
+		return "link"
+	default:
+		return "unknown"
+	}
+}
+
+// IsDir returns true for directories, including
+// the current and the parent one.
+func (t EntryType) IsDir() bool {
+	return t == EntryDir || t == EntryCurrentDir || t == EntryParentDir
+}
+
+// Entry is an item of a directory listing.
+// Each field is set only if the format contains it.
+type Entry struct {
+	// Name is the pathname as sent by the server: the name of the
+	// file for MLSD and LIST, usually the full path for MLST.
+	Name string
+	Type EntryType
+	// Size is the size in bytes, 0 if unknown.
+	Size int64
+	// ModTime is the last modification time, zero if unknown.
+	ModTime time.Time
+	// Mode contains the permission bits and the type, as
+	// shown by `ls -l` or sent with the UNIX.mode fact.
+	Mode os.FileMode
+	// Owner and Group are the names (or ids) of the owners.
+	Owner string
+	Group string
+	// Perm is the value of the MLSx perm fact, e.g. "adfrw".
+	Perm string
+	// Unique identifies the file on the server.
+	Unique string
+	// Target is the destination of a link, if known.
+	Target string
+	// Facts contains any other MLSx fact sent by the
+	// server, the names are lower case.
+	Facts map[string]string
+}
+
+var (
+	// ErrSkip is returned by a parser when the line
+	// is not an entry, e.g. the "total" line of `ls -l`.
+	ErrSkip = errors.New("listing: line is not an entry")
+
+	// ErrUnknownFormat is returned when no parser
+	// recognizes the format of the line.
+	ErrUnknownFormat = errors.New("listing: unknown format")
+)
@@ -0,0 +1,476 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package listing
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parser parses a single line of the output of LIST.
+// It must return ErrUnknownFormat if the line is not in its format,
+// so that the next parser is tried, and ErrSkip if the line is in
+// its format but it's not an entry.
+// `now` is used to infer the year when the format omits it.
+type Parser func(line string, now time.Time) (*Entry, error)
+
+var (
+	parsersLock   sync.RWMutex
+	customParsers []Parser
+)
+
+// builtinParsers are tried in this order, after the custom ones.
+var builtinParsers = []Parser{ParseEPLF, ParseUnix, ParseDOS}
+
+// Register adds a parser for a custom format. The custom
+// parsers are tried in order of registration, before the
+// built-in ones.
+func Register(parser Parser) {
+	parsersLock.Lock()
+	defer parsersLock.Unlock()
+	customParsers = append(customParsers, parser)
+}
+
+// Parse parses a single line of the output of LIST, trying
+// every registered parser and then the built-in ones.
+func Parse(line string, now time.Time) (*Entry, error) {
+	return parse(line, now, nil)
+}
+
+// parse is like Parse, but `preferred`, if not
+// nil, is tried before the built-in parsers.
+func parse(line string, now time.Time, preferred Parser) (*Entry, error) {
+	parsersLock.RLock()
+	parsers := append([]Parser(nil), customParsers...)
+	parsersLock.RUnlock()
+	if preferred != nil {
+		parsers = append(parsers, preferred)
+	}
+	parsers = append(parsers, builtinParsers...)
+
+	line = strings.TrimRight(line, "\r\n")
+	for _, parser := range parsers {
+		entry, err := parser(line, now)
+		if err != ErrUnknownFormat {
+			return entry, err
+		}
+	}
+	return nil, ErrUnknownFormat
+}
+
+// SystemParser returns the built-in parser of the format used by
+// the servers whose system type, as told by SYST, is `system`,
+// e.g. ParseUnix for UNIX. It returns nil if the system is unknown.
+func SystemParser(system string) Parser {
+	switch strings.ToUpper(system) {
+	case "UNIX":
+		return ParseUnix
+	case "WINDOWS_NT":
+		return ParseDOS
+	}
+	return nil
+}
+
+// ParseList parses the output of LIST, one line per element as
+// returned by LsSimple and LsDirSimple. The lines that are not
+// entries are skipped, any other error is returned.
+func ParseList(lines []string, now time.Time) ([]Entry, error) {
+	return ParseSystemList(lines, "", now)
+}
+
+// ParseSystemList is like ParseList, but the parser of `system`,
+// as returned by SystemParser, is tried before the other built-in
+// ones, so that the lines that fit more formats are parsed right.
+func ParseSystemList(lines []string, system string, now time.Time) ([]Entry, error) {
+	preferred := SystemParser(system)
+	entries := make([]Entry, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entry, err := parse(line, now, preferred)
+		if err == ErrSkip {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// field is a whitespace separated field of a line,
+// `end` is the index right after its last char.
+type field struct {
+	text string
+	end  int
+}
+
+func splitFields(line string) []field {
+	var fields []field
+	start := -1
+	for i, c := range line {
+		if c == ' ' || c == '\t' {
+			if start != -1 {
+				fields = append(fields, field{text: line[start:i], end: i})
+				start = -1
+			}
+		} else if start == -1 {
+			start = i
+		}
+	}
+	if start != -1 {
+		fields = append(fields, field{text: line[start:], end: len(line)})
+	}
+	return fields
+}
+
+// nameAfter returns what follows the given field, that is the name.
+func nameAfter(line string, f field) string {
+	return strings.TrimLeft(line[f.end:], " \t")
+}
+
+// ParseUnix parses the `ls -l` format, used by most of the servers:
+//
+//	drwxr-xr-x   2 owner group 4096 Mar 12 11:30 name
+//	-rw-r--r--   1 owner group 1024 Mar 12  2017 name
+//	lrwxrwxrwx   1 owner group    4 Mar 12 11:30 link -> target
+//
+// The group and the number of links can be missing.
+// When the year is missing, the file has been modified in the
+// last six months, so the year is the one that puts the date
+// in the past with respect to `now`.
+func ParseUnix(line string, now time.Time) (*Entry, error) {
+	fields := splitFields(line)
+	if len(fields) == 2 && fields[0].text == "total" {
+		if _, err := strconv.Atoi(fields[1].text); err == nil {
+			return nil, ErrSkip
+		}
+	}
+	if len(fields) < 6 {
+		return nil, ErrUnknownFormat
+	}
+
+	entry := &Entry{}
+	if !entry.setUnixMode(fields[0].text) {
+		return nil, ErrUnknownFormat
+	}
+
+	// the date is the first month name followed by a day and
+	// by a time or a year, preceded by the size.
+	month := -1
+	for i := 3; i+3 < len(fields); i++ {
+		if modTime, ok := unixTime(fields[i].text, fields[i+1].text, fields[i+2].text, now); ok {
+			entry.ModTime = modTime
+			month = i
+			break
+		}
+	}
+	if month == -1 {
+		return nil, ErrUnknownFormat
+	}
+
+	size, err := strconv.ParseInt(fields[month-1].text, 10, 64)
+	if err != nil {
+		return nil, ErrUnknownFormat
+	}
+	entry.Size = size
+
+	owners := fields[1 : month-1]
+	if len(owners) > 1 {
+		// skipping the number of links.
+		if _, err = strconv.Atoi(owners[0].text); err == nil {
+			owners = owners[1:]
+		}
+	}
+	if len(owners) > 0 {
+		entry.Owner = owners[0].text
+	}
+	if len(owners) > 1 {
+		entry.Group = owners[1].text
+	}
+
+	entry.Name = nameAfter(line, fields[month+2])
+	if entry.Type == EntryLink {
+		if ind := strings.Index(entry.Name, " -> "); ind != -1 {
+			entry.Name, entry.Target = entry.Name[:ind], entry.Name[ind+4:]
+		}
+	}
+	entry.setDotType()
+	return entry, nil
+}
+
+// setUnixMode parses the mode as shown by `ls -l`, e.g. drwxr-xr-x.
+func (e *Entry) setUnixMode(mode string) bool {
+	// some servers append the ACL flag.
+	mode = strings.TrimRight(mode, "+@.")
+	if len(mode) != 10 {
+		return false
+	}
+
+	switch mode[0] {
+	case '-':
+		e.Type = EntryFile
+	case 'd':
+		e.Type = EntryDir
+		e.Mode |= os.ModeDir
+	case 'l':
+		e.Type = EntryLink
+		e.Mode |= os.ModeSymlink
+	case 'c':
+		e.Mode |= os.ModeDevice | os.ModeCharDevice
+	case 'b':
+		e.Mode |= os.ModeDevice
+	case 'p':
+		e.Mode |= os.ModeNamedPipe
+	case 's':
+		e.Mode |= os.ModeSocket
+	default:
+		return false
+	}
+
+	bits := []os.FileMode{0400, 0200, 0100, 0040, 0020, 0010, 0004, 0002, 0001}
+	for i, bit := range bits {
+		c := mode[i+1]
+		switch {
+		case c == '-':
+		case c == "rwxrwxrwx"[i]:
+			e.Mode |= bit
+		case (i == 2 || i == 5) && (c == 's' || c == 'S'):
+			if i == 2 {
+				e.Mode |= os.ModeSetuid
+			} else {
+				e.Mode |= os.ModeSetgid
+			}
+			if c == 's' {
+				e.Mode |= bit
+			}
+		case i == 8 && (c == 't' || c == 'T'):
+			e.Mode |= os.ModeSticky
+			if c == 't' {
+				e.Mode |= bit
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setDotType marks the current and the parent directory,
+// as MLSD does with cdir and pdir.
+func (e *Entry) setDotType() {
+	if e.Type != EntryDir {
+		return
+	}
+	switch e.Name {
+	case ".":
+		e.Type = EntryCurrentDir
+	case "..":
+		e.Type = EntryParentDir
+	}
+}
+
+var months = map[string]time.Month{
+	"jan": time.January,
+	"feb": time.February,
+	"mar": time.March,
+	"apr": time.April,
+	"may": time.May,
+	"jun": time.June,
+	"jul": time.July,
+	"aug": time.August,
+	"sep": time.September,
+	"oct": time.October,
+	"nov": time.November,
+	"dec": time.December,
+}
+
+// unixTime parses the date of `ls -l`, the time is returned in UTC.
+func unixTime(monthStr, dayStr, timeOrYear string, now time.Time) (time.Time, bool) {
+	month, ok := months[strings.ToLower(monthStr)]
+	if !ok {
+		return time.Time{}, false
+	}
+	day, err := strconv.Atoi(dayStr)
+	if err != nil || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+
+	if ind := strings.Index(timeOrYear, ":"); ind != -1 {
+		hour, errHour := strconv.Atoi(timeOrYear[:ind])
+		minute, errMinute := strconv.Atoi(timeOrYear[ind+1:])
+		if errHour != nil || errMinute != nil || hour > 23 || minute > 59 {
+			return time.Time{}, false
+		}
+		year := now.Year()
+		modTime := time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+		// a day of tolerance for the timezones.
+		if modTime.After(now.Add(24 * time.Hour)) {
+			modTime = time.Date(year-1, month, day, hour, minute, 0, 0, time.UTC)
+		}
+		return modTime, true
+	}
+
+	year, err := strconv.Atoi(timeOrYear)
+	if err != nil || len(timeOrYear) != 4 {
+		return time.Time{}, false
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC), true
+}
+
+// ParseDOS parses the format used by Windows servers, e.g. IIS:
+//
+//	03-12-18  11:30AM       <DIR>          name
+//	03-12-2018  23:30              1024 name
+//
+// The year can have two or four digits, the time can be
+// in 12 or 24 hours format.
+func ParseDOS(line string, now time.Time) (*Entry, error) {
+	fields := splitFields(line)
+	if len(fields) < 4 {
+		return nil, ErrUnknownFormat
+	}
+
+	date, ok := dosTime(fields[0].text, fields[1].text)
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+
+	entry := &Entry{ModTime: date}
+	if strings.EqualFold(fields[2].text, "<DIR>") {
+		entry.Type = EntryDir
+		entry.Mode = os.ModeDir
+	} else {
+		size, err := strconv.ParseInt(fields[2].text, 10, 64)
+		if err != nil {
+			return nil, ErrUnknownFormat
+		}
+		entry.Type = EntryFile
+		entry.Size = size
+	}
+	entry.Name = nameAfter(line, fields[2])
+	entry.setDotType()
+	return entry, nil
+}
+
+// dosTime parses MM-DD-YY and hh:mm[AM|PM], the time is returned in UTC.
+func dosTime(dateStr, timeStr string) (time.Time, bool) {
+	date := strings.Split(dateStr, "-")
+	if len(date) != 3 {
+		return time.Time{}, false
+	}
+	month, errMonth := strconv.Atoi(date[0])
+	day, errDay := strconv.Atoi(date[1])
+	year, errYear := strconv.Atoi(date[2])
+	if errMonth != nil || errDay != nil || errYear != nil ||
+		month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+	switch len(date[2]) {
+	case 2:
+		// as strptime does.
+		if year < 69 {
+			year += 2000
+		} else {
+			year += 1900
+		}
+	case 4:
+	default:
+		return time.Time{}, false
+	}
+
+	upper := strings.ToUpper(timeStr)
+	pm := strings.HasSuffix(upper, "PM")
+	twelve := pm || strings.HasSuffix(upper, "AM")
+	if twelve {
+		upper = upper[:len(upper)-2]
+	}
+	ind := strings.Index(upper, ":")
+	if ind == -1 {
+		return time.Time{}, false
+	}
+	hour, errHour := strconv.Atoi(upper[:ind])
+	minute, errMinute := strconv.Atoi(upper[ind+1:])
+	if errHour != nil || errMinute != nil || hour > 23 || minute > 59 {
+		return time.Time{}, false
+	}
+	if twelve {
+		if hour < 1 || hour > 12 {
+			return time.Time{}, false
+		}
+		hour %= 12
+		if pm {
+			hour += 12
+		}
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC), true
+}
+
+// ParseEPLF parses the Easily Parsed LIST Format,
+// see https://cr.yp.to/ftp/list/eplf.html
+//
+//	+i8388621.48594,m825718503,r,s280,\tdjb.html
+func ParseEPLF(line string, now time.Time) (*Entry, error) {
+	if !strings.HasPrefix(line, "+") {
+		return nil, ErrUnknownFormat
+	}
+	ind := strings.Index(line, "\t")
+	if ind == -1 || ind == len(line)-1 {
+		return nil, ErrUnknownFormat
+	}
+
+	entry := &Entry{Name: line[ind+1:]}
+	for _, fact := range strings.Split(line[1:ind], ",") {
+		if fact == "" {
+			continue
+		}
+		switch fact[0] {
+		case 'r':
+			entry.Type = EntryFile
+		case '/':
+			entry.Type = EntryDir
+			entry.Mode |= os.ModeDir
+		case 's':
+			size, err := strconv.ParseInt(fact[1:], 10, 64)
+			if err != nil {
+				return nil, ErrUnknownFormat
+			}
+			entry.Size = size
+		case 'm':
+			seconds, err := strconv.ParseInt(fact[1:], 10, 64)
+			if err != nil {
+				return nil, ErrUnknownFormat
+			}
+			entry.ModTime = time.Unix(seconds, 0).UTC()
+		case 'i':
+			entry.Unique = fact[1:]
+		case 'u':
+			if strings.HasPrefix(fact, "up") {
+				mode, err := strconv.ParseUint(fact[2:], 8, 32)
+				if err != nil {
+					return nil, ErrUnknownFormat
+				}
+				entry.Mode |= os.FileMode(mode) & os.ModePerm
+			}
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package listing
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMLSx(t *testing.T) {
+	entry, err := ParseMLSx("type=file;size=1024;modify=20180312113045.123;perm=adfrw;unique=801U1A;UNIX.mode=0644;x.custom=1; my file.txt")
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	expected := &Entry{
+		Name:    "my file.txt",
+		Type:    EntryFile,
+		Size:    1024,
+		ModTime: time.Date(2018, 3, 12, 11, 30, 45, 123000000, time.UTC),
+		Mode:    0644,
+		Perm:    "adfrw",
+		Unique:  "801U1A",
+		Facts:   map[string]string{"x.custom": "1"},
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Wrong entry, expected %+v, got %+v", expected, entry)
+	}
+
+	types := map[string]EntryType{
+		"type=cdir; .":                    EntryCurrentDir,
+		"Type=pdir; ..":                   EntryParentDir,
+		"type=dir;sizd=4096; dir":         EntryDir,
+		"type=OS.unix=slink:/target; lnk": EntryLink,
+		"type=OS.unix=blkdev; sda":        EntryUnknown,
+		" nofacts":                        EntryUnknown,
+	}
+	for line, entryType := range types {
+		entry, err = ParseMLSx(line)
+		if err != nil {
+			t.Errorf("Got error on %q: %s", line, err.Error())
+			continue
+		}
+		if entry.Type != entryType {
+			t.Errorf("Wrong type of %q, expected %s, got %s", line, entryType, entry.Type)
+		}
+	}
+	if entry, _ = ParseMLSx("type=OS.unix=slink:/target; lnk"); entry.Target != "/target" {
+		t.Errorf("Wrong link target: %q", entry.Target)
+	}
+
+	for _, line := range []string{"type=file;size=1", "type=file;size=abc; name", "typefile; name"} {
+		if _, err = ParseMLSx(line); err == nil {
+			t.Errorf("Expected error on %q", line)
+		}
+	}
+}
+
+func TestParseUnix(t *testing.T) {
+	now := time.Date(2018, 3, 12, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]Entry{
+		"drwxr-xr-x   2 owner group 4096 Mar 12 11:30 my dir": {
+			Name: "my dir", Type: EntryDir, Size: 4096,
+			ModTime: time.Date(2018, 3, 12, 11, 30, 0, 0, time.UTC),
+			Mode:    os.ModeDir | 0755, Owner: "owner", Group: "group",
+		},
+		// in the future, so it's last year.
+		"-rw-r--r--   1 owner group 1024 Dec 24 18:00 file.txt": {
+			Name: "file.txt", Type: EntryFile, Size: 1024,
+			ModTime: time.Date(2017, 12, 24, 18, 0, 0, 0, time.UTC),
+			Mode:    0644, Owner: "owner", Group: "group",
+		},
+		"-rw-r-----   1 owner  1024 Feb  3  2015 nogroup": {
+			Name: "nogroup", Type: EntryFile, Size: 1024,
+			ModTime: time.Date(2015, 2, 3, 0, 0, 0, 0, time.UTC),
+			Mode:    0640, Owner: "owner",
+		},
+		"lrwxrwxrwx 1 0 0 7 Mar 1 09:05 link -> /target": {
+			Name: "link", Type: EntryLink, Size: 7, Target: "/target",
+			ModTime: time.Date(2018, 3, 1, 9, 5, 0, 0, time.UTC),
+			Mode:    os.ModeSymlink | 0777, Owner: "0", Group: "0",
+		},
+		"drwxrwxrwt+  9 root root 4096 Jan 10 2018 tmp": {
+			Name: "tmp", Type: EntryDir, Size: 4096,
+			ModTime: time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC),
+			Mode:    os.ModeDir | os.ModeSticky | 0777, Owner: "root", Group: "root",
+		},
+		"-rwsr-xr-x 1 root root 10 Jan 10 2018 suid": {
+			Name: "suid", Type: EntryFile, Size: 10,
+			ModTime: time.Date(2018, 1, 10, 0, 0, 0, 0, time.UTC),
+			Mode:    os.ModeSetuid | 0755, Owner: "root", Group: "root",
+		},
+		"drwxr-xr-x 2 owner group 4096 Mar 12 11:30 ..": {
+			Name: "..", Type: EntryParentDir, Size: 4096,
+			ModTime: time.Date(2018, 3, 12, 11, 30, 0, 0, time.UTC),
+			Mode:    os.ModeDir | 0755, Owner: "owner", Group: "group",
+		},
+	}
+	for line, expected := range tests {
+		entry, err := ParseUnix(line, now)
+		if err != nil {
+			t.Errorf("Got error on %q: %s", line, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(*entry, expected) {
+			t.Errorf("Wrong entry for %q, expected %+v, got %+v", line, expected, *entry)
+		}
+	}
+
+	if _, err := ParseUnix("total 42", now); err != ErrSkip {
+		t.Errorf("Expected ErrSkip, got %v", err)
+	}
+	for _, line := range []string{
+		"03-12-18  11:30AM       <DIR>          dir",
+		"-rw-r--r-- 1 owner group abc Mar 12 11:30 name",
+		"xrw-r--r-- 1 owner group 1 Mar 12 11:30 name",
+		"-rw-r--r-- 1 owner group 1 Mar 12 11:30",
+	} {
+		if _, err := ParseUnix(line, now); err != ErrUnknownFormat {
+			t.Errorf("Expected ErrUnknownFormat on %q, got %v", line, err)
+		}
+	}
+}
+
+func TestParseDOS(t *testing.T) {
+	tests := map[string]Entry{
+		"03-12-18  11:30AM       <DIR>          my dir": {
+			Name: "my dir", Type: EntryDir, Mode: os.ModeDir,
+			ModTime: time.Date(2018, 3, 12, 11, 30, 0, 0, time.UTC),
+		},
+		"12-31-1999  12:05AM              1024 file.txt": {
+			Name: "file.txt", Type: EntryFile, Size: 1024,
+			ModTime: time.Date(1999, 12, 31, 0, 5, 0, 0, time.UTC),
+		},
+		"01-02-70  23:59              1 old": {
+			Name: "old", Type: EntryFile, Size: 1,
+			ModTime: time.Date(1970, 1, 2, 23, 59, 0, 0, time.UTC),
+		},
+		"01-02-18  12:15PM              1 noon": {
+			Name: "noon", Type: EntryFile, Size: 1,
+			ModTime: time.Date(2018, 1, 2, 12, 15, 0, 0, time.UTC),
+		},
+	}
+	for line, expected := range tests {
+		entry, err := ParseDOS(line, time.Now())
+		if err != nil {
+			t.Errorf("Got error on %q: %s", line, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(*entry, expected) {
+			t.Errorf("Wrong entry for %q, expected %+v, got %+v", line, expected, *entry)
+		}
+	}
+
+	for _, line := range []string{
+		"drwxr-xr-x 2 owner group 4096 Mar 12 11:30 dir",
+		"13-12-18  11:30AM       <DIR>          dir",
+		"03-12-18  13:30PM       <DIR>          dir",
+	} {
+		if _, err := ParseDOS(line, time.Now()); err != ErrUnknownFormat {
+			t.Errorf("Expected ErrUnknownFormat on %q, got %v", line, err)
+		}
+	}
+}
+
+func TestParseEPLF(t *testing.T) {
+	entry, err := ParseEPLF("+i8388621.48594,m825718503,r,s280,up644,\tdjb.html", time.Now())
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	expected := Entry{
+		Name: "djb.html", Type: EntryFile, Size: 280, Mode: 0644,
+		ModTime: time.Unix(825718503, 0).UTC(), Unique: "8388621.48594",
+	}
+	if !reflect.DeepEqual(*entry, expected) {
+		t.Errorf("Wrong entry, expected %+v, got %+v", expected, *entry)
+	}
+
+	if entry, err = ParseEPLF("+i8388621.50690,m824255907,/,\t514", time.Now()); err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if entry.Type != EntryDir || entry.Name != "514" {
+		t.Errorf("Wrong entry: %+v", *entry)
+	}
+}
+
+func TestParseList(t *testing.T) {
+	lines := []string{
+		"total 8",
+		"drwxr-xr-x 2 owner group 4096 Mar 12 11:30 dir",
+		"03-12-18  11:30AM              1024 file.txt",
+		"+m825718503,r,s280,\tdjb.html",
+		"",
+	}
+	entries, err := ParseList(lines, time.Now())
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if strings.Join(names, ",") != "dir,file.txt,djb.html" {
+		t.Errorf("Wrong entries: %v", names)
+	}
+
+	if _, err = ParseList([]string{"garbage"}, time.Now()); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	// a VMS-like format.
+	Register(func(line string, now time.Time) (*Entry, error) {
+		ind := strings.Index(line, ";")
+		if ind == -1 {
+			return nil, ErrUnknownFormat
+		}
+		return &Entry{Name: line[:ind], Type: EntryFile}, nil
+	})
+
+	entries, err := ParseList([]string{"FILE.TXT;1", "-rw-r--r-- 1 o g 1 Mar 12 11:30 file"}, time.Now())
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(entries) != 2 || entries[0].Name != "FILE.TXT" || entries[1].Name != "file" {
+		t.Errorf("Wrong entries: %+v", entries)
+	}
+}
+
+func TestSystemParser(t *testing.T) {
+	unixLine := "-rw-r--r-- 1 owner group 1024 Mar 12 11:30 file.txt"
+	dosLine := "03-12-18  11:30AM              1024 file.txt"
+	tests := []struct {
+		system string
+		line   string
+	}{
+		{"UNIX", unixLine},
+		{"Windows_NT", dosLine},
+	}
+	for _, test := range tests {
+		parser := SystemParser(test.system)
+		if parser == nil {
+			t.Fatalf("%s: no parser", test.system)
+		}
+		if entry, err := parser(test.line, time.Now()); err != nil || entry.Name != "file.txt" {
+			t.Errorf("%s: wrong entry %+v, error %v", test.system, entry, err)
+		}
+	}
+	if _, err := SystemParser("Windows_NT")(unixLine, time.Now()); err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+	if SystemParser("VMS") != nil {
+		t.Errorf("Expected no parser for VMS")
+	}
+
+	// the other formats are still recognized.
+	entries, err := ParseSystemList([]string{dosLine, unixLine}, "UNIX", time.Now())
+	if err != nil {
+		t.Fatalf("Got error: %s", err.Error())
+	}
+	if len(entries) != 2 || entries[0].Size != 1024 || entries[1].Size != 1024 {
+		t.Errorf("Wrong entries: %+v", entries)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package listing
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MlsxTimeLayout is the format of the times used by MLSx
+// and MDTM, always in UTC. When parsing, fractions of second
+// are accepted as well.
+const MlsxTimeLayout = "20060102150405"
+
+// ParseMLSx parses a line in the MLSx format, see
+// https://tools.ietf.org/html/rfc3659#section-7
+//
+//	fact=value;fact=value; name
+func ParseMLSx(line string) (*Entry, error) {
+	ind := strings.Index(line, " ")
+	if ind == -1 {
+		return nil, errors.New("Fail to parse MLSx entry")
+	}
+	facts, name := line[:ind], line[ind+1:]
+	if name == "" {
+		return nil, errors.New("Fail to parse MLSx entry")
+	}
+
+	entry := &Entry{Name: name}
+	for _, fact := range strings.Split(facts, ";") {
+		if fact == "" {
+			continue
+		}
+		ind = strings.Index(fact, "=")
+		if ind == -1 {
+			return nil, errors.New("Fail to parse MLSx fact")
+		}
+		key, value := strings.ToLower(fact[:ind]), fact[ind+1:]
+		if err := entry.setFact(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+func (e *Entry) setFact(key, value string) error {
+	var err error
+	switch key {
+	case "type":
+		e.setType(value)
+	case "size", "sizd":
+		e.Size, err = strconv.ParseInt(value, 10, 64)
+	case "modify":
+		e.ModTime, err = time.Parse(MlsxTimeLayout, value)
+	case "perm":
+		e.Perm = value
+	case "unique":
+		e.Unique = value
+	case "unix.mode":
+		var mode uint64
+		if mode, err = strconv.ParseUint(value, 8, 32); err == nil {
+			e.Mode = e.Mode&os.ModeType | os.FileMode(mode)&os.ModePerm
+		}
+	case "unix.owner", "unix.uid":
+		e.Owner = value
+	case "unix.group", "unix.gid":
+		e.Group = value
+	default:
+		e.setUnknownFact(key, value)
+	}
+	return err
+}
+
+// setType parses the type fact. Links are not covered by the RFC,
+// but many servers use OS.unix=slink:target or OS.unix=symlink.
+func (e *Entry) setType(value string) {
+	lower := strings.ToLower(value)
+	switch {
+	case lower == "file":
+		e.Type = EntryFile
+	case lower == "dir":
+		e.Type = EntryDir
+	case lower == "cdir":
+		e.Type = EntryCurrentDir
+	case lower == "pdir":
+		e.Type = EntryParentDir
+	case strings.HasPrefix(lower, "os.unix=slink"):
+		e.Type = EntryLink
+		if ind := strings.Index(value, ":"); ind != -1 {
+			e.Target = value[ind+1:]
+		}
+	case lower == "os.unix=symlink":
+		e.Type = EntryLink
+	default:
+		e.Type = EntryUnknown
+		e.setUnknownFact("type", value)
+	}
+
+	e.Mode &^= os.ModeType
+	if e.Type.IsDir() {
+		e.Mode |= os.ModeDir
+	} else if e.Type == EntryLink {
+		e.Mode |= os.ModeSymlink
+	}
+}
+
+func (e *Entry) setUnknownFact(key, value string) {
+	if e.Facts == nil {
+		e.Facts = make(map[string]string)
+	}
+	e.Facts[key] = value
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// controlLock serializes the use of the control connection, so that
+// the command/reply exchanges of different goroutines never interleave.
+// It's a channel rather than a sync.Mutex so that waiting for it can
+// be interrupted by a context. The zero value is unlocked.
+type controlLock struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (l *controlLock) channel() chan struct{} {
+	l.once.Do(func() {
+		l.ch = make(chan struct{}, 1)
+	})
+	return l.ch
+}
+
+// acquire takes the lock of the control connection, waiting for
+// the exchange or the transfer in progress, if any, to finish.
+// It returns the error of `ctx` if it's done before.
+func (f *Conn) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case f.lock.channel() <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tryAcquire takes the lock of the control connection
+// if it's free, without waiting.
+func (f *Conn) tryAcquire() bool {
+	select {
+	case f.lock.channel() <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release gives back the lock taken with acquire.
+func (f *Conn) release() {
+	f.lastUsed = time.Now()
+	<-f.lock.channel()
+}
+
+// locked runs `exchange` holding the lock of the control connection.
+func (f *Conn) locked(exchange func() error) error {
+	f.acquire(context.Background())
+	defer f.release()
+	return exchange()
+}
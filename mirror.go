@@ -0,0 +1,381 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MirrorOptions are the optional params of UploadDir and DownloadDir.
+// A nil *MirrorOptions means the defaults.
+type MirrorOptions struct {
+	// Mode is the mode used for the data connections,
+	// IndMode means the default one.
+	Mode Mode
+	// Include, if not empty, are the patterns of the files to transfer,
+	// Exclude are the patterns of the files and directories to ignore.
+	// A pattern uses the path.Match syntax and it's matched against
+	// both the slash-separated path relative to the root and the name,
+	// e.g. "*.go" and "vendor/*" are valid patterns.
+	Include []string
+	Exclude []string
+	// PreserveTimes sets the modification time of the copies equal to
+	// the one of the originals. On upload Conn.SetModificationTime is
+	// used, servers that support none of its commands are silently ignored.
+	PreserveTimes bool
+	// SkipSame doesn't transfer the files whose copy already has the
+	// same size and modification time, compared with second precision.
+	// The remote times are taken from MLSD, or from MDTM when MLSD
+	// is not supported.
+	SkipSame bool
+	// DryRun fills the report without creating or transferring anything.
+	DryRun bool
+}
+
+// MirrorReport is the result of UploadDir and DownloadDir,
+// the paths are slash-separated and relative to the roots.
+type MirrorReport struct {
+	// Dirs are the directories created.
+	Dirs []string
+	// Transferred are the files transferred.
+	Transferred []string
+	// Skipped are the files not transferred because of SkipSame.
+	Skipped []string
+	// Excluded are the files and directories matching the patterns.
+	Excluded []string
+	// Bytes is the total size of the transferred files.
+	Bytes int64
+}
+
+// UploadDir uploads the content of the local directory `localDir` to
+// `remoteDir`, creating the directories that don't exist. The files
+// already present are overwritten, unless SkipSame is used.
+// Links and special files are skipped.
+// When an error occurs, the report of what has been done so far is
+// returned together with the error.
+func (f *Conn) UploadDir(localDir, remoteDir string, opts *MirrorOptions) (*MirrorReport, error) {
+	return f.UploadDirContext(context.Background(), localDir, remoteDir, opts)
+}
+
+// UploadDirContext is the context-based version of UploadDir.
+func (f *Conn) UploadDirContext(ctx context.Context, localDir, remoteDir string, opts *MirrorOptions) (*MirrorReport, error) {
+	m := newMirror(f, ctx, opts)
+	err := filepath.Walk(localDir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		remotePath := path.Join(remoteDir, rel)
+
+		if info.IsDir() {
+			return m.uploadDir(rel, remotePath)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return m.uploadFile(rel, localPath, remotePath, info)
+	})
+	return m.report, err
+}
+
+// DownloadDir downloads the content of the remote directory `remoteDir`
+// to `localDir`, creating the directories that don't exist. The files
+// already present are overwritten, unless SkipSame is used.
+// Links and special files are skipped.
+// When an error occurs, the report of what has been done so far is
+// returned together with the error.
+func (f *Conn) DownloadDir(remoteDir, localDir string, opts *MirrorOptions) (*MirrorReport, error) {
+	return f.DownloadDirContext(context.Background(), remoteDir, localDir, opts)
+}
+
+// DownloadDirContext is the context-based version of DownloadDir.
+func (f *Conn) DownloadDirContext(ctx context.Context, remoteDir, localDir string, opts *MirrorOptions) (*MirrorReport, error) {
+	m := newMirror(f, ctx, opts)
+	err := f.WalkContext(ctx, remoteDir, func(remotePath string, entry *Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		rel := RelativePath(remoteDir, remotePath)
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+
+		if entry.Type.IsDir() {
+			return m.downloadDir(rel, localPath)
+		}
+		if entry.Type != EntryFile {
+			return nil
+		}
+		return m.downloadFile(rel, remotePath, localPath, entry)
+	}, &WalkOptions{Mode: m.opts.Mode})
+	return m.report, err
+}
+
+type mirror struct {
+	ftpConn *Conn
+	ctx     context.Context
+	opts    *MirrorOptions
+	report  *MirrorReport
+	// walker is used to read the remote directories.
+	walker *walker
+	// remoteDirs are the items of the remote directories
+	// already read during an upload, by name.
+	remoteDirs map[string]map[string]*Entry
+}
+
+func newMirror(f *Conn, ctx context.Context, opts *MirrorOptions) *mirror {
+	if opts == nil {
+		opts = &MirrorOptions{}
+	}
+	return &mirror{
+		ftpConn: f,
+		ctx:     ctx,
+		opts:    opts,
+		report:  &MirrorReport{},
+		walker: &walker{
+			ftpConn: f,
+			ctx:     ctx,
+			opts:    &WalkOptions{Mode: opts.Mode},
+		},
+		remoteDirs: make(map[string]map[string]*Entry),
+	}
+}
+
+func (m *mirror) uploadDir(rel, remotePath string) error {
+	if rel != "." && m.excluded(rel) {
+		m.report.Excluded = append(m.report.Excluded, rel)
+		return SkipDir
+	}
+
+	items := make(map[string]*Entry)
+	m.remoteDirs[remotePath] = items
+
+	// some servers (e.g. vsftpd) list a missing directory as an
+	// empty one, so the listing can't tell if it exists.
+	exists, err := m.remoteDirExists(remotePath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		m.report.Dirs = append(m.report.Dirs, rel)
+		if m.opts.DryRun {
+			return nil
+		}
+		_, err = m.ftpConn.MkDirContext(m.ctx, remotePath)
+		return err
+	}
+
+	entries, err := m.walker.readDir(remotePath)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		items[entries[i].Name] = &entries[i]
+	}
+	return nil
+}
+
+// remoteDirExists returns true if `remotePath` exists, using MLST or,
+// without it, trying to enter it. Only a 550 reply means it doesn't
+// exist, if it's not a directory MKD fails.
+func (m *mirror) remoteDirExists(remotePath string) (bool, error) {
+	f := m.ftpConn
+	hasMLST := f.hasMLST()
+	var entry *Entry
+	err := f.withContext(m.ctx, func() (err error) {
+		if hasMLST {
+			entry, err = f.mlst(remotePath)
+			return
+		}
+		_, current, err := f.pwd()
+		if err != nil {
+			return err
+		}
+		if _, err = f.cd(remotePath); err != nil {
+			return err
+		}
+		entry = &Entry{Type: EntryDir}
+		_, err = f.cd(current)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return entry.Type.IsDir(), nil
+}
+
+func (m *mirror) uploadFile(rel, localPath, remotePath string, info os.FileInfo) error {
+	if !m.included(rel) {
+		m.report.Excluded = append(m.report.Excluded, rel)
+		return nil
+	}
+
+	if m.opts.SkipSame {
+		entry := m.remoteDirs[path.Dir(remotePath)][path.Base(remotePath)]
+		if entry != nil && entry.Type == EntryFile && entry.Size == info.Size() &&
+			sameTime(m.remoteModTime(remotePath, entry), info.ModTime()) {
+			m.report.Skipped = append(m.report.Skipped, rel)
+			return nil
+		}
+	}
+
+	m.report.Transferred = append(m.report.Transferred, rel)
+	m.report.Bytes += info.Size()
+	if m.opts.DryRun {
+		return nil
+	}
+
+	err := m.ftpConn.StoreContext(m.ctx, m.opts.Mode, localPath, remotePath, nil)
+	if err != nil || !m.opts.PreserveTimes {
+		return err
+	}
+	err = m.ftpConn.withContext(m.ctx, func() error {
+		_, err := m.ftpConn.setModificationTime(remotePath, info.ModTime())
+		return err
+	})
+	// the servers that support none of the commands are ignored.
+	var featureErr *FeatureNotSupportedError
+	if errors.As(err, &featureErr) {
+		return nil
+	}
+	return err
+}
+
+func (m *mirror) downloadDir(rel, localPath string) error {
+	if rel != "." && m.excluded(rel) {
+		m.report.Excluded = append(m.report.Excluded, rel)
+		return SkipDir
+	}
+
+	_, err := os.Stat(localPath)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	m.report.Dirs = append(m.report.Dirs, rel)
+	if m.opts.DryRun {
+		return nil
+	}
+	return os.MkdirAll(localPath, 0755)
+}
+
+func (m *mirror) downloadFile(rel, remotePath, localPath string, entry *Entry) error {
+	if !m.included(rel) {
+		m.report.Excluded = append(m.report.Excluded, rel)
+		return nil
+	}
+
+	var modTime time.Time
+	if m.opts.SkipSame || m.opts.PreserveTimes {
+		modTime = m.remoteModTime(remotePath, entry)
+	}
+
+	if m.opts.SkipSame {
+		info, err := os.Stat(localPath)
+		if err == nil && info.Mode().IsRegular() && info.Size() == entry.Size &&
+			sameTime(modTime, info.ModTime()) {
+			m.report.Skipped = append(m.report.Skipped, rel)
+			return nil
+		}
+	}
+
+	m.report.Transferred = append(m.report.Transferred, rel)
+	m.report.Bytes += entry.Size
+	if m.opts.DryRun {
+		return nil
+	}
+
+	err := m.ftpConn.RetrieveContext(m.ctx, m.opts.Mode, remotePath, localPath, nil)
+	if err != nil || !m.opts.PreserveTimes || modTime.IsZero() {
+		return err
+	}
+	return os.Chtimes(localPath, modTime, modTime)
+}
+
+// remoteModTime returns the modification time of `remotePath`. The time
+// of the LIST entries has no seconds, so MDTM is preferred to it.
+func (m *mirror) remoteModTime(remotePath string, entry *Entry) time.Time {
+	if m.ftpConn.hasMLST() && !entry.ModTime.IsZero() {
+		return entry.ModTime
+	}
+	if _, modTime, err := m.ftpConn.LastModificationTime(remotePath); err == nil {
+		return *modTime
+	}
+	return entry.ModTime
+}
+
+// included returns true if the file `rel` matches the
+// include patterns and doesn't match the exclude ones.
+func (m *mirror) included(rel string) bool {
+	if m.excluded(rel) {
+		return false
+	}
+	return len(m.opts.Include) == 0 || MatchAny(m.opts.Include, rel)
+}
+
+func (m *mirror) excluded(rel string) bool {
+	return MatchAny(m.opts.Exclude, rel)
+}
+
+// MatchAny returns true if one of `patterns` matches the slash-separated
+// path `rel` or its last element, as the patterns of MirrorOptions do.
+func MatchAny(patterns []string, rel string) bool {
+	name := path.Base(rel)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RelativePath returns the slash-separated path `p` relative to `root`,
+// `p` being `root` joined with zero or more names, e.g. a path
+// passed to a WalkFunc.
+func RelativePath(root, p string) string {
+	root, p = path.Clean(root), path.Clean(p)
+	if p == root {
+		return "."
+	}
+	if root == "." {
+		return p
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, root), "/")
+}
+
+func sameTime(t1, t2 time.Time) bool {
+	return !t1.IsZero() && t1.Truncate(time.Second).Equal(t2.Truncate(time.Second))
+}
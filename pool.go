@@ -0,0 +1,254 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned by Acquire once the pool is closed.
+var ErrPoolClosed = errors.New("The pool is closed")
+
+// PoolOptions are the optional params of NewPool.
+// A nil *PoolOptions means the defaults.
+type PoolOptions struct {
+	// Size is the number of connections dialed by NewPool,
+	// the others are dialed when needed.
+	Size int
+	// MaxConns is the maximum number of connections open to the server
+	// at the same time, when they're all in use Acquire waits for one
+	// to be released. 0 means Size, or 1 if Size is 0 too.
+	MaxConns int
+	// HealthCheckInterval is how long a connection can stay idle
+	// before being checked with Noop when it's acquired, a connection
+	// failing the check is replaced with a new one.
+	// 0 means that the connections are always checked.
+	HealthCheckInterval time.Duration
+}
+
+// Pool is a set of authenticated connections to the same server, that
+// can be used by multiple goroutines for parallel transfers, since a Conn
+// runs one transfer at a time. A Conn is taken with Acquire and given
+// back with Release, or with Discard if it's broken.
+type Pool struct {
+	remote string
+	config Config
+	opts   PoolOptions
+
+	// slots limits the connections in use, there's
+	// never an idle connection when they're all taken.
+	slots chan struct{}
+
+	lock   sync.Mutex
+	idle   []idleConn
+	inUse  map[*Conn]bool
+	closed bool
+}
+
+type idleConn struct {
+	conn  *Conn
+	since time.Time
+}
+
+// NewPool creates a pool of connections to `remote`, each one dialed
+// and authenticated using `config`. The LocalPort of `config` is not
+// used, since the connections can't share it.
+func NewPool(remote string, config *Config, opts *PoolOptions) (*Pool, error) {
+	if opts == nil {
+		opts = &PoolOptions{}
+	}
+	p := &Pool{
+		remote: remote,
+		config: *config,
+		opts:   *opts,
+		inUse:  make(map[*Conn]bool),
+	}
+	p.config.LocalPort = 0
+	if p.opts.MaxConns <= 0 {
+		p.opts.MaxConns = p.opts.Size
+	}
+	if p.opts.MaxConns <= 0 {
+		p.opts.MaxConns = 1
+	}
+	p.slots = make(chan struct{}, p.opts.MaxConns)
+
+	for i := 0; i < p.opts.Size && i < p.opts.MaxConns; i++ {
+		conn, err := p.dial(context.Background())
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+	}
+	return p, nil
+}
+
+// Acquire returns a connection of the pool, waiting if they're all
+// in use. An idle connection is checked before being returned, a new
+// one is dialed if there are none or if the check fails.
+func (p *Pool) Acquire(ctx context.Context) (*Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	conn, err := p.take(ctx)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+// take returns an idle and healthy connection, or a new one.
+func (p *Pool) take(ctx context.Context) (*Conn, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.lock.Unlock()
+			break
+		}
+		// the most recently used, which is the most likely alive.
+		idle := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.lock.Unlock()
+
+		if time.Since(idle.since) >= p.opts.HealthCheckInterval {
+			if _, err := idle.conn.NoopContext(ctx); err != nil {
+				idle.conn.close()
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+		}
+		return p.markInUse(idle.conn)
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.markInUse(conn)
+}
+
+func (p *Pool) markInUse(conn *Conn) (*Conn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		shutdown(conn)
+		return nil, ErrPoolClosed
+	}
+	p.inUse[conn] = true
+	return conn, nil
+}
+
+// dial opens and authenticates a new connection.
+func (p *Pool) dial(ctx context.Context) (*Conn, error) {
+	config := p.config
+	conn, _, err := DialContext(ctx, p.remote, &config)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.withContext(ctx, func() error {
+		_, err := conn.authenticate()
+		return err
+	})
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Release gives back to the pool a connection taken with Acquire.
+// The connection must be in a usable state, with no transfer running.
+func (p *Pool) Release(conn *Conn) {
+	p.lock.Lock()
+	if !p.inUse[conn] {
+		p.lock.Unlock()
+		return
+	}
+	delete(p.inUse, conn)
+	closed := p.closed
+	if !closed {
+		p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+	}
+	p.lock.Unlock()
+
+	if closed {
+		shutdown(conn)
+	}
+	<-p.slots
+}
+
+// Discard closes a connection taken with Acquire, that
+// is not usable anymore, freeing its place in the pool.
+func (p *Pool) Discard(conn *Conn) {
+	p.lock.Lock()
+	if !p.inUse[conn] {
+		p.lock.Unlock()
+		return
+	}
+	delete(p.inUse, conn)
+	p.lock.Unlock()
+
+	conn.close()
+	<-p.slots
+}
+
+// Close closes the idle connections, the ones in use are
+// closed when released. Acquire returns ErrPoolClosed after it.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.lock.Unlock()
+
+	var err error
+	for _, i := range idle {
+		if quitErr := shutdown(i.conn); quitErr != nil && err == nil {
+			err = quitErr
+		}
+	}
+	return err
+}
+
+// shutdown sends QUIT, closing the connection anyway if it fails.
+func shutdown(conn *Conn) error {
+	_, err := conn.Quit()
+	if err != nil {
+		conn.close()
+	}
+	return err
+}
+
+// close closes the control connection without sending QUIT,
+// it's used when the connection is broken.
+func (f *Conn) close() error {
+	f.cancel()
+	return f.control.Close()
+}
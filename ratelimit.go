@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the bandwidth of the transfers. It can be set
+// in the Config, limiting all the transfers of a Conn, or of a Pool
+// since its connections share the Config, and in the TransferOptions,
+// limiting a single transfer. The same RateLimiter can be shared by
+// many Conn, limiting all of them together.
+// It's safe for concurrent use, and the rate can be changed at any time.
+type RateLimiter struct {
+	lock sync.Mutex
+	// rate is in bytes per second, 0 means no limit.
+	rate  int
+	burst int
+	// tokens are the bytes that can be moved now,
+	// it's negative when the next bytes have to wait.
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows `rate` bytes per
+// second, with bursts up to `burst` bytes. A `rate` <= 0 means no limit,
+// a `burst` <= 0 means `rate`.
+func NewRateLimiter(rate, burst int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate, burst)
+	return l
+}
+
+// SetRate changes the rate and the burst, as in NewRateLimiter.
+// The transfers in progress use them from the next chunk.
+func (l *RateLimiter) SetRate(rate, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.refill(now)
+	if rate < 0 {
+		rate = 0
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	if l.rate == 0 {
+		// a bucket starts full.
+		l.tokens = float64(burst)
+	}
+	l.rate, l.burst = rate, burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+	l.last = now
+}
+
+// Rate returns the rate and the burst in use.
+func (l *RateLimiter) Rate() (rate, burst int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate, l.burst
+}
+
+// refill adds the tokens accumulated since the last time.
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate == 0 {
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// reserve takes `n` bytes, and returns how long to wait
+// before moving them. A nil RateLimiter never waits.
+func (l *RateLimiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// throttle waits until `n` bytes can be moved according to the
+// RateLimiter of the config and the one of the transfer,
+// or until the transfer is aborted.
+func (f *Conn) throttle(t *transfer, n int) {
+	delay := f.config.RateLimit.reserve(n)
+	if transferDelay := t.rateLimit.reserve(n); transferDelay > delay {
+		delay = transferDelay
+	}
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-f.ctx.Done():
+	case <-t.done():
+	case <-t.abort:
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// DefaultRetryCodes are the reply codes retried when
+// the Codes of a RetryPolicy are nil.
+var DefaultRetryCodes = []int{ServiceNotAvailable, CantOpenDataConn, AbortOk, FileUnavailable}
+
+// RetryPolicy tells which failures are transient and how many times
+// the operation is tried again. If the control connection has been
+// lost, or the server has closed it with a 421 reply, the connection
+// is dialed again: the login, the TLS negotiation, the data protection
+// level and the working directory are restored before retrying.
+//
+// The commands of Conn are retried, but not the ones of the channel-based
+// transfers. StoreContext and RetrieveContext resume the transfer, like
+// TransferOptions.Resume, if the data connection of the failed attempt
+// had been opened, otherwise they start it again. RetrieveTo restarts
+// from the last byte received if the server supports REST STREAM. The
+// other transfers are retried only if the data connection couldn't be opened.
+// Note that a command that succeeded but whose reply has been lost is
+// executed twice, e.g. a retried MkDir fails if the first one succeeded.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, the first one
+	// included. A value lower than 2 means that nothing is retried.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it's doubled
+	// before each of the following ones, up to MaxBackoff
+	// if it's not 0.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Codes are the reply codes that are retried, nil means
+	// DefaultRetryCodes. Failures because the connection has
+	// been closed, reset or refused, and timeouts, are always retried.
+	Codes []int
+	// Retryable, if not nil, is used instead of Codes
+	// to decide whether `err` is transient.
+	Retryable func(err error) bool
+}
+
+// retryable returns true if the operation failed with `err` can be retried.
+func (p *RetryPolicy) retryable(err error) bool {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	if isConnectionError(err) || isTimeoutError(err) {
+		return true
+	}
+	code, ok := replyCode(err)
+	if !ok {
+		return false
+	}
+	codes := p.Codes
+	if codes == nil {
+		codes = DefaultRetryCodes
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the retry following `attempt`.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			break
+		}
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// isConnectionError returns true if `err` means that the connection
+// has been closed or reset by the other side, or refused.
+func isConnectionError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// replyCode returns the code of the reply `err` has been built from.
+func replyCode(err error) (int, bool) {
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) {
+		return protocolErr.Response.Code, true
+	}
+	var codeErr *UnexpectedCodeError
+	if errors.As(err, &codeErr) {
+		return codeErr.Got, true
+	}
+	return 0, false
+}
+
+// needsReconnect returns true if the control connection
+// can't be used anymore after `err`. When a transfer fails
+// because of the data connection, the final reply of the
+// transfer is never read, so the control connection is
+// not usable either, and neither it is after a timeout.
+func needsReconnect(err error) bool {
+	code, ok := replyCode(err)
+	return isConnectionError(err) || isTimeoutError(err) || ok && code == ServiceNotAvailable
+}
+
+// retry runs `op` until it succeeds or it fails with an error that can't
+// be retried, according to the RetryPolicy of the config. `again`, if not
+// nil, is called before each retry to prepare it, and it returns false
+// if the operation can't be retried. It's called once the connection has
+// been restored, so that it can be used. The lock must be held.
+func (f *Conn) retry(ctx context.Context, op func() error, again func() bool) error {
+	policy := f.config.Retry
+	var lastErr error
+	broken := false
+	for attempt := 1; ; attempt++ {
+		var err error
+		if broken {
+			_, withTLS := f.control.(*tls.Conn)
+			err = f.reconnect(ctx, withTLS)
+		}
+		if err == nil {
+			if attempt > 1 && again != nil && !again() {
+				return lastErr
+			}
+			err = op()
+			broken = needsReconnect(err)
+		}
+		if err == nil || policy == nil || attempt >= policy.MaxAttempts ||
+			ctx.Err() != nil || f.ctx.Err() != nil || !policy.retryable(err) {
+			return err
+		}
+		lastErr = err
+
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		case <-f.ctx.Done():
+			return err
+		}
+	}
+}
+
+// reconnect replaces the control connection with a new one, restoring
+// the session: the login, the TLS negotiation if `withTLS`, the
+// data protection level and the working directory.
+// The lock must be held.
+func (f *Conn) reconnect(ctx context.Context, withTLS bool) error {
+	f.control.Close()
+
+	// the local port of the old connection may not
+	// be available yet, the TLS params are restored here.
+	config := *f.config
+	config.LocalPort = 0
+	tlsOption := *f.config.TLSOption
+	tlsOption.ImplicitTLS = withTLS && tlsOption.ImplicitTLS
+	tlsOption.AuthTLSOnFirst = withTLS && !tlsOption.ImplicitTLS
+	tlsOption.ContinueIfNoSSL = false
+	tlsOption.ProtectData = false
+	config.TLSOption = &tlsOption
+
+	conn, _, err := internalDial(ctx, f.remote, &config)
+	if err != nil {
+		return err
+	}
+	// only its control connection is kept.
+	conn.cancel()
+
+	err = conn.watched(ctx, func() error {
+		if withTLS && f.protection != ProtectionClear {
+			if _, err := conn.setDataProtection(f.protection); err != nil {
+				return err
+			}
+		}
+		if f.loggedIn {
+			if _, err := conn.authenticate(); err != nil {
+				return err
+			}
+		}
+		if f.cwd != "" {
+			if _, err := conn.cd(f.cwd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		conn.control.Close()
+		return err
+	}
+
+	f.control, f.controlRw = conn.control, conn.controlRw
+	if withTLS {
+		// the data connections resume the new TLS session.
+		f.tlsConfig, f.dataTLSConfig = conn.tlsConfig, conn.dataTLSConfig
+	}
+	// they're sent again if needed.
+	f.features, f.utf8 = nil, false
+	f.serverType = conn.serverType
+	f.pendingNoops = 0
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// TimeoutPhase tells which of the timeouts of Config has expired.
+type TimeoutPhase string
+
+const (
+	// TimeoutDial is the phase of Config.DialTimeout.
+	TimeoutDial = TimeoutPhase("dial")
+	// TimeoutCommand is the phase of Config.CommandTimeout.
+	TimeoutCommand = TimeoutPhase("command")
+	// TimeoutDataConn is the phase of Config.DataConnTimeout.
+	TimeoutDataConn = TimeoutPhase("data connection")
+	// TimeoutStall is the phase of Config.StallTimeout.
+	TimeoutStall = TimeoutPhase("transfer stall")
+)
+
+// TimeoutError is the error returned when one of the timeouts of
+// Config expires. It's a net.Error whose Timeout method returns true.
+// After a timeout, the control connection is left in an unknown state
+// and should be closed, unless a RetryPolicy is used: timeouts are
+// retried, dialing a new connection.
+type TimeoutError struct {
+	// Phase is what has timed out.
+	Phase TimeoutPhase
+	// After is the timeout that has expired.
+	After time.Duration
+	// Err is the error caused by the timeout.
+	Err error
+}
+
+func newTimeoutError(phase TimeoutPhase, after time.Duration, err error) error {
+	return &TimeoutError{Phase: phase, After: after, Err: err}
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %s: %v", e.Phase, e.After, e.Err)
+}
+
+// Unwrap returns the error caused by the timeout.
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout is always true.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary is always true.
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// isTimeout returns true if `err` is the error of an expired deadline.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isTimeoutError returns true if `err` is a TimeoutError.
+func isTimeoutError(err error) bool {
+	var timeoutErr *TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// withTimeout returns `ctx` bounded by `timeout`, if it's not 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError returns the TimeoutError of `phase` if `err` has been
+// caused by the expiration of `timeoutCtx`, derived from `ctx`.
+func timeoutError(ctx, timeoutCtx context.Context, phase TimeoutPhase, timeout time.Duration, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	// the deadline set on the socket may expire a moment before the
+	// timer of the context does.
+	if timeoutCtx.Err() == context.DeadlineExceeded || deadlinePassed(timeoutCtx) {
+		return newTimeoutError(phase, timeout, err)
+	}
+	return err
+}
+
+// deadlinePassed reports whether the deadline of ctx, if any, is over.
+func deadlinePassed(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// watchReply bounds the wait for a reply line with the CommandTimeout
+// of the config. The returned function stops it and reports whether
+// the timeout has expired, it must be called once the line is read.
+func (f *Conn) watchReply() func() bool {
+	timeout := f.config.CommandTimeout
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+	var lock sync.Mutex
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		expired = true
+		f.control.SetReadDeadline(aLongTimeAgo)
+	})
+	return func() bool {
+		if timer.Stop() {
+			return false
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		// the next reads must not fail because of it.
+		f.control.SetReadDeadline(time.Time{})
+		return expired
+	}
+}
+
+// stallRead reads from the data connection `conn`, failing with a
+// TimeoutError if nothing is received within the StallTimeout of the config.
+func (f *Conn) stallRead(conn net.Conn, p []byte) (int, error) {
+	timeout := f.config.StallTimeout
+	if timeout <= 0 {
+		return conn.Read(p)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(p)
+	if err != nil && isTimeout(err) {
+		return n, newTimeoutError(TimeoutStall, timeout, err)
+	}
+	return n, err
+}
+
+// stallWrite is like stallRead, but it writes `p` to `conn`.
+func (f *Conn) stallWrite(conn net.Conn, p []byte) (int, error) {
+	timeout := f.config.StallTimeout
+	if timeout <= 0 {
+		return conn.Write(p)
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	n, err := conn.Write(p)
+	if err != nil && isTimeout(err) {
+		return n, newTimeoutError(TimeoutStall, timeout, err)
+	}
+	return n, err
+}
@@ -0,0 +1,512 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"net"
+)
+
+// errAborted is returned internally when a transfer
+// has been aborted, after the ABOR exchange.
+var errAborted = errors.New("transfer aborted")
+
+// transfer contains the parameters of a single data transfer.
+// Every field can be left to its zero value.
+type transfer struct {
+	// ctx aborts the transfer when done.
+	ctx context.Context
+	// abort aborts the transfer when something is received.
+	abort <-chan struct{}
+	// onStart is called once the data connection is open,
+	// if it fails the transfer is aborted.
+	onStart func() error
+	// onEach is called with the number of bytes of each chunk.
+	onEach     func(int)
+	bufferSize int
+	// rateLimit limits the transfer, along with the one of the config.
+	rateLimit *RateLimiter
+	// dataType, if not empty, overrides the type of the Conn.
+	dataType TransferType
+	// verifyChecksum, if not empty, is the algorithm of checksum,
+	// that hashes the bytes moved by the last attempt.
+	verifyChecksum HashAlgorithm
+	checksum       hash.Hash
+	// offset is where the transfer starts, sent with REST.
+	offset int64
+	// resume, deleteIfAbort and appendOnly are used
+	// by the functions that work on local files.
+	resume        bool
+	deleteIfAbort bool
+	appendOnly    bool
+	preserveTimes bool
+	// started is set once the data connection is open, and transferred
+	// counts the bytes sent or received since then. They're used
+	// to retry the transfer.
+	started     bool
+	transferred int64
+}
+
+func (t *transfer) done() <-chan struct{} {
+	if t.ctx == nil {
+		return nil
+	}
+	return t.ctx.Done()
+}
+
+// notStarted returns true if the data connection has not
+// been opened, so that the transfer can be retried.
+func (t *transfer) notStarted() bool {
+	return !t.started
+}
+
+// context returns the context of the transfer, never nil.
+func (t *transfer) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// resetChecksum starts the checksum of a new attempt, if required.
+func (t *transfer) resetChecksum() (err error) {
+	if t.verifyChecksum != "" {
+		t.checksum, err = newHash(t.verifyChecksum)
+	}
+	return
+}
+
+// newTransfer builds the params of a transfer from the user options.
+func newTransfer(ctx context.Context, opts *TransferOptions) *transfer {
+	t := &transfer{ctx: ctx}
+	if opts == nil {
+		return t
+	}
+	t.bufferSize = opts.BufferSize
+	t.rateLimit = opts.RateLimit
+	t.dataType = opts.Type
+	t.verifyChecksum = opts.VerifyChecksum
+	t.preserveTimes = opts.PreserveTimes
+	t.resume = opts.Resume
+	t.deleteIfAbort = opts.DeleteIfAbort
+	if progress := opts.Progress; progress != nil {
+		t.onStart = func() error {
+			progress.Started()
+			return nil
+		}
+		t.onEach = progress.Transferred
+	}
+	return t
+}
+
+// useType sends TYPE, if needed, before the transfer `t`.
+func (f *Conn) useType(t *transfer) error {
+	return f.watched(t.context(), func() error {
+		return f.ensureType(f.transferType(t))
+	})
+}
+
+// aborted returns true if any of the abort
+// conditions of the transfer has been met.
+func (f *Conn) aborted(t *transfer) bool {
+	select {
+	case <-f.ctx.Done():
+		return true
+	case <-t.done():
+		return true
+	case <-t.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// abortError returns the error to return to the user
+// when a transfer started by a public function has been aborted.
+func (f *Conn) abortError(t *transfer) error {
+	if t.ctx != nil && t.ctx.Err() != nil {
+		return t.ctx.Err()
+	}
+	if t.ctx != nil && deadlinePassed(t.ctx) {
+		return context.DeadlineExceeded
+	}
+	if f.ctx.Err() != nil {
+		return f.ctx.Err()
+	}
+	return errAborted
+}
+
+func (f *Conn) transferBufferSize(bufferSize int) int {
+	if bufferSize > 0 && bufferSize <= MaxAllowedBufferSize {
+		return bufferSize
+	}
+	return f.bufferSize
+}
+
+// storeFrom opens a data connection using `cmd` (STOR, APPE...)
+// and sends everything is read from r over it.
+// If the transfer is aborted, errAborted is returned.
+func (f *Conn) storeFrom(mode Mode, cmd string, r io.Reader, t *transfer) error {
+	if err := f.useType(t); err != nil {
+		return err
+	}
+	if f.serverType == TypeASCII {
+		r = newLineReader(r, &toCRLF{})
+	}
+	if err := t.resetChecksum(); err != nil {
+		return err
+	}
+	sender, err := f.openDataConn(t.context(), mode, cmd, t.offset)
+	if err != nil {
+		return err
+	}
+	t.started = true
+	// unblocking the data connection when aborted.
+	defer f.watchTransfer(t, sender)()
+
+	if t.onStart != nil {
+		if err = t.onStart(); err != nil {
+			sender.Close()
+			f.finishTransfer(t, f.abortTransfer)
+			return err
+		}
+	}
+
+	buffer := make([]byte, f.transferBufferSize(t.bufferSize))
+	// the replies to the NOOPs must not be taken for the ones of
+	// the next commands, whatever the outcome of the transfer.
+	defer f.drainNoops()
+	stopKeepAlive := f.keepAliveTransfer()
+	defer stopKeepAlive()
+
+	for {
+		if f.aborted(t) {
+			// it's not completely correct to close here the data channel,
+			// but some server will expect the client to do this.
+			sender.Close()
+			stopKeepAlive()
+			if err = f.finishTransfer(t, f.abortTransfer); err != nil {
+				return err
+			}
+			return errAborted
+		}
+
+		read, err := r.Read(buffer)
+		if read > 0 {
+			f.throttle(t, read)
+			if _, writeErr := f.stallWrite(sender, buffer[:read]); writeErr != nil {
+				if f.aborted(t) {
+					continue
+				}
+				sender.Close()
+				f.finishTransfer(t, f.abortTransfer)
+				return writeErr
+			}
+			t.transferred += int64(read)
+			if t.checksum != nil {
+				t.checksum.Write(buffer[:read])
+			}
+			if t.onEach != nil {
+				t.onEach(read)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// closing the data connection alone would tell
+			// the server that the file is complete.
+			sender.Close()
+			f.finishTransfer(t, f.abortTransfer)
+			return err
+		}
+	}
+
+	// until I close the data connection it doesn't answer me.
+	sender.Close()
+	stopKeepAlive()
+
+	// when completed reading response.
+	return f.finishTransfer(t, f.transferReply)
+}
+
+// retrieveTo opens a data connection using `cmd` (RETR...)
+// and writes everything is received over it into w.
+// If the transfer is aborted, errAborted is returned.
+func (f *Conn) retrieveTo(mode Mode, cmd string, w io.Writer, t *transfer) error {
+	if err := f.useType(t); err != nil {
+		return err
+	}
+	var lines *lineWriter
+	if f.serverType == TypeASCII {
+		lines = newLineWriter(w, &toLF{})
+		w = lines
+	}
+	if err := t.resetChecksum(); err != nil {
+		return err
+	}
+	receiver, err := f.openDataConn(t.context(), mode, cmd, t.offset)
+	if err != nil {
+		return err
+	}
+	t.started = true
+	// unblocking the data connection when aborted.
+	defer f.watchTransfer(t, receiver)()
+
+	if t.onStart != nil {
+		if err = t.onStart(); err != nil {
+			receiver.Close()
+			f.finishTransfer(t, f.abortTransfer)
+			return err
+		}
+	}
+
+	buffer := make([]byte, f.transferBufferSize(t.bufferSize))
+	defer f.drainNoops()
+	stopKeepAlive := f.keepAliveTransfer()
+	defer stopKeepAlive()
+
+	for {
+		if f.aborted(t) {
+			receiver.Close()
+			stopKeepAlive()
+			if err = f.finishTransfer(t, f.abortTransfer); err != nil {
+				return err
+			}
+			return errAborted
+		}
+
+		n, err := f.stallRead(receiver, buffer)
+		if n > 0 {
+			f.throttle(t, n)
+			if t.onEach != nil {
+				t.onEach(n)
+			}
+			if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
+				// closing the connection as well
+				receiver.Close()
+				f.finishTransfer(t, f.abortTransfer)
+				return writeErr
+			}
+			t.transferred += int64(n)
+			if t.checksum != nil {
+				t.checksum.Write(buffer[:n])
+			}
+		}
+		// EOF means the connection has been closed.
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if f.aborted(t) {
+				continue
+			}
+			receiver.Close()
+			f.finishTransfer(t, f.abortTransfer)
+			return err
+		}
+	}
+
+	receiver.Close()
+	stopKeepAlive()
+
+	if lines != nil {
+		if err = lines.flush(); err != nil {
+			f.finishTransfer(t, f.transferReply)
+			return err
+		}
+	}
+
+	// now getting the response.
+	return f.finishTransfer(t, f.transferReply)
+}
+
+// finishTransfer runs the last exchange of the transfer `t`, transferReply
+// or abortTransfer, watching the control connection with the context
+// of the transfer, so that its deadline bounds the whole transfer.
+// If the context is already done, being the reason of the abort,
+// the exchange is bounded by the CommandTimeout only.
+// If the context interrupts the exchange, errAborted is returned.
+func (f *Conn) finishTransfer(t *transfer, exchange func() error) error {
+	ctx := t.context()
+	if ctx.Err() != nil {
+		return exchange()
+	}
+	err := f.watched(ctx, exchange)
+	if err != nil && (ctx.Err() != nil || deadlinePassed(ctx)) {
+		return errAborted
+	}
+	return err
+}
+
+// transferReply reads the reply sent once the transfer is complete,
+// a transient failure (e.g. 426) is reported as an error too.
+func (f *Conn) transferReply() error {
+	response, err := f.transferResponse()
+	if err != nil {
+		return err
+	}
+	f.drainNoops()
+	if response.Code >= 300 {
+		return newProtocolError(TransferOk, response)
+	}
+	return nil
+}
+
+// watchTransfer unblocks any pending I/O on the data connection
+// as soon as the transfer or the connection context is done,
+// so that the transfer can be aborted.
+// The returned function must be called when the transfer is finished.
+func (f *Conn) watchTransfer(t *transfer, conn net.Conn) func() {
+	stopCtx := watch(t.context(), conn.SetDeadline)
+	stopConn := watch(f.ctx, conn.SetDeadline)
+	return func() {
+		stopCtx()
+		stopConn()
+	}
+}
+
+// abortTransfer sends ABOR and reads the replies.
+func (f *Conn) abortTransfer() error {
+	/*
+				This command tells the server to abort the previous FTP
+		service command and any associated transfer of data.  The
+		abort command may require "special action", as discussed in
+		the Section on FTP Commands, to force recognition by the
+		server.  No action is to be taken if the previous command
+		has been completed (including data transfer).  The control
+		connection is not to be closed by the server, but the data
+		connection must be closed.
+
+		There are two cases for the server upon receipt of this
+		command: (1) the FTP service command was already completed,
+		or (2) the FTP service command is still in progress.
+
+			 In the first case, the server closes the data connection
+			 (if it is open) and responds with a 226 reply, indicating
+			 that the abort command was successfully processed.
+
+			 In the second case, the server aborts the FTP service in
+			 progress and closes the data connection, returning a 426
+			 reply to indicate that the service request terminated
+			 abnormally.  The server then sends a 226 reply,
+			 indicating that the abort command was successfully
+			 processed.
+	*/
+	if err := f.writeCommand("ABOR\r\n"); err != nil {
+		return err
+	}
+	response, err := f.transferResponse()
+	if err != nil {
+		return err
+	}
+
+	// SOME SERVER LIKE APACHE WILL RETURN US A 226
+	// EVEN IF NO FILE HAS BEEN TRANSFERED, WHILE,
+	// ACCORDING TO RFC IT'D RETURN US A 426 FOLLOWED BY A 226.
+	// SO IT RETURNS US 226 AND 226.
+	if response.Code != AbortOk && response.Code != TransferOk {
+		return newProtocolError(AbortOk, response)
+	}
+
+	// after the first response, server must send another with
+	// 226.
+	abortResponse, err := f.transferResponse()
+	if err != nil {
+		return err
+	}
+	if abortResponse.Code != TransferOk {
+		return newProtocolError(TransferOk, abortResponse)
+	}
+	f.drainNoops()
+	return nil
+}
+
+// writerFunc is an io.Writer built from a function.
+type writerFunc func([]byte) (int, error)
+
+func (w writerFunc) Write(p []byte) (int, error) {
+	return w(p)
+}
+
+// dataReader is the io.ReadCloser returned by OpenRead.
+type dataReader struct {
+	ftpConn *Conn
+	conn    net.Conn
+	eof     bool
+	closed  bool
+}
+
+func (r *dataReader) Read(p []byte) (int, error) {
+	n, err := r.ftpConn.stallRead(r.conn, p)
+	r.ftpConn.throttle(&transfer{}, n)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close closes the data connection and reads the final reply,
+// a reply other than 2xx (e.g. 426) is returned as a *ProtocolError.
+// If the file has not been read until the end, the transfer is aborted.
+func (r *dataReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	// letting the other commands go on.
+	defer r.ftpConn.release()
+
+	r.conn.Close()
+	if !r.eof {
+		return r.ftpConn.abortTransfer()
+	}
+	return r.ftpConn.transferReply()
+}
+
+// dataWriter is the io.WriteCloser returned by OpenWrite.
+type dataWriter struct {
+	ftpConn *Conn
+	conn    net.Conn
+	closed  bool
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	w.ftpConn.throttle(&transfer{}, len(p))
+	return w.ftpConn.stallWrite(w.conn, p)
+}
+
+// Close closes the data connection, telling the server that
+// the file is complete, and reads the final reply, a reply other
+// than 2xx (e.g. 452) is returned as a *ProtocolError.
+func (w *dataWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	// letting the other commands go on.
+	defer w.ftpConn.release()
+
+	closeErr := w.conn.Close()
+	// the server answers even if the close failed.
+	err := w.ftpConn.transferReply()
+	if closeErr != nil {
+		return closeErr
+	}
+	return err
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2018 Nicola Bena
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ftp
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// SkipDir can be returned by a WalkFunc to skip a directory,
+// it's the same value of filepath.SkipDir.
+var SkipDir = filepath.SkipDir
+
+// WalkFunc is the function called by Walk for each file or directory,
+// it works as filepath.WalkFunc:
+//   - if reading a directory fails, the function is called a second time
+//     for that directory with the error;
+//   - if it returns SkipDir on a directory, the directory is skipped, if it
+//     returns SkipDir on a file, the remaining files of its directory are skipped;
+//   - any other error stops the walk and it's returned by Walk.
+//
+// `remotePath` is `root` joined with the names of the entries.
+type WalkFunc func(remotePath string, entry *Entry, err error) error
+
+// WalkOptions are the optional params of Walk.
+// A nil *WalkOptions means the defaults.
+type WalkOptions struct {
+	// Mode is the mode used for the data connections,
+	// IndMode means the default one.
+	Mode Mode
+	// MaxDepth is the maximum depth of the entries passed to the
+	// WalkFunc, the root has depth 0 and its items depth 1.
+	// 0 means no limit.
+	MaxDepth int
+	// FollowSymlinks descends into the links to directories.
+	// To avoid loops, a directory is never visited twice if the
+	// server sends the unique fact, otherwise use MaxDepth.
+	FollowSymlinks bool
+}
+
+// Walk walks the remote tree rooted at `root`, calling `fn` for each
+// file or directory, including `root`. The items of each directory
+// are walked in lexical order.
+// MLSD is used when the server supports it, otherwise the output of
+// LIST is parsed with the listing package.
+func (f *Conn) Walk(root string, fn WalkFunc, opts *WalkOptions) error {
+	return f.WalkContext(context.Background(), root, fn, opts)
+}
+
+// WalkContext is the context-based version of Walk.
+func (f *Conn) WalkContext(ctx context.Context, root string, fn WalkFunc, opts *WalkOptions) error {
+	if opts == nil {
+		opts = &WalkOptions{}
+	}
+	w := &walker{
+		ftpConn: f,
+		ctx:     ctx,
+		fn:      fn,
+		opts:    opts,
+		visited: make(map[string]bool),
+	}
+
+	rootEntry := w.rootEntry(root)
+	err := fn(root, rootEntry, nil)
+	if err != nil || !rootEntry.Type.IsDir() {
+		if err == SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	err = w.walkDir(root, rootEntry, 1)
+	if err == SkipDir {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	ftpConn *Conn
+	ctx     context.Context
+	fn      WalkFunc
+	opts    *WalkOptions
+	// visited are the unique ids of the directories already
+	// walked, used to avoid loops when following links.
+	visited map[string]bool
+}
+
+// rootEntry returns the entry of the root, using MLST if
+// available, otherwise it's assumed to be a directory.
+func (w *walker) rootEntry(root string) *Entry {
+	if w.ftpConn.hasMLST() {
+		if entry, err := w.ftpConn.MLST(root); err == nil {
+			entry.Name = path.Base(root)
+			if entry.Type == EntryCurrentDir {
+				entry.Type = EntryDir
+			}
+			return entry
+		}
+	}
+	return &Entry{Name: path.Base(root), Type: EntryDir}
+}
+
+// walkDir walks the items of `dir`, that have the given depth.
+func (w *walker) walkDir(dir string, dirEntry *Entry, depth int) error {
+	if dirEntry.Unique != "" {
+		if w.visited[dirEntry.Unique] {
+			return nil
+		}
+		w.visited[dirEntry.Unique] = true
+	}
+
+	entries, err := w.readDir(dir)
+	if err != nil {
+		// giving the function the possibility to go on.
+		if err = w.fn(dir, dirEntry, err); err == SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		entryPath := path.Join(dir, entry.Name)
+
+		if entry.Type == EntryLink && w.opts.FollowSymlinks {
+			if target, ok := w.linkedDir(entryPath); ok {
+				entry = target
+			}
+		}
+
+		err = w.fn(entryPath, entry, nil)
+		if err == SkipDir {
+			if entry.Type.IsDir() {
+				continue
+			}
+			// skipping the remaining files of this directory.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !entry.Type.IsDir() || (w.opts.MaxDepth > 0 && depth >= w.opts.MaxDepth) {
+			continue
+		}
+		if err = w.walkDir(entryPath, entry, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDir returns the items of `dir` sorted by name,
+// without the current and the parent directory.
+func (w *walker) readDir(dir string) ([]Entry, error) {
+	var entries []Entry
+	var err error
+	if w.ftpConn.hasMLST() {
+		entries, err = w.ftpConn.MLSDContext(w.ctx, w.opts.Mode, dir)
+	} else {
+		entries, err = w.ftpConn.ListEntries(w.ctx, w.opts.Mode, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := entries[:0]
+	for _, entry := range entries {
+		// some servers send the full path.
+		entry.Name = path.Base(entry.Name)
+		if entry.Type == EntryCurrentDir || entry.Type == EntryParentDir ||
+			entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		items = append(items, entry)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// linkedDir returns the entry of the directory linked by `linkPath`,
+// or false if the link doesn't point to a directory.
+func (w *walker) linkedDir(linkPath string) (*Entry, bool) {
+	if w.ftpConn.hasMLST() {
+		// MLST follows the links.
+		entry, err := w.ftpConn.MLST(linkPath)
+		if err != nil || !entry.Type.IsDir() {
+			return nil, false
+		}
+		entry.Name = path.Base(linkPath)
+		entry.Type = EntryDir
+		return entry, true
+	}
+
+	// without MLST the only way is trying to enter it.
+	_, current, err := w.ftpConn.Pwd()
+	if err != nil {
+		return nil, false
+	}
+	if _, err = w.ftpConn.Cd(linkPath); err != nil {
+		return nil, false
+	}
+	w.ftpConn.Cd(current)
+	return &Entry{Name: path.Base(linkPath), Type: EntryDir}, true
+}
+
+// hasMLST returns true if the server advertises MLST.
+func (f *Conn) hasMLST() bool {
+	features, err := f.Features()
+	return err == nil && features.Has("MLST")
+}